@@ -0,0 +1,192 @@
+package bitcask
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/decimalbell/bitcask/entry"
+)
+
+// Batch collects puts and deletes to be written atomically by
+// Bitcask.Write. The zero value is an empty batch ready to use.
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+// Put adds setting key to value to the batch. The batch keeps copies of
+// key and value.
+func (batch *Batch) Put(key, value []byte) {
+	batch.ops = append(batch.ops, batchOp{
+		key:   append([]byte(nil), key...),
+		value: append([]byte(nil), value...),
+	})
+}
+
+// Delete adds deleting key to the batch.
+func (batch *Batch) Delete(key []byte) {
+	batch.ops = append(batch.ops, batchOp{
+		key:    append([]byte(nil), key...),
+		delete: true,
+	})
+}
+
+// Len returns the number of puts and deletes in the batch.
+func (batch *Batch) Len() int {
+	return len(batch.ops)
+}
+
+// Reset empties the batch so it can be reused.
+func (batch *Batch) Reset() {
+	batch.ops = batch.ops[:0]
+}
+
+// Write appends every put and delete of batch to the active file in one
+// go, followed by a commit record. After a crash the batch is either
+// applied as a whole or not at all. Operations on the same key take effect
+// in the order they were added.
+func (bitcask *Bitcask) Write(ctx context.Context, batch *Batch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+	ts := uint32(time.Now().Unix())
+
+	return bitcask.commit(func() error {
+		return bitcask.writeLocked(ctx, batch, ts)
+	})
+}
+
+// writeLocked appends batch for both Write and transactions, so it checks
+// the sizes of the keys and values too.
+func (bitcask *Bitcask) writeLocked(ctx context.Context, batch *Batch, ts uint32) error {
+	for _, op := range batch.ops {
+		if err := bitcask.checkSize(op.key, op.value); err != nil {
+			return err
+		}
+	}
+	seq := bitcask.seq
+	crypter := bitcask.options.crypter
+	values := make([][]byte, len(batch.ops))
+	flags := make([]uint32, len(batch.ops))
+	n := len(encodeCommit(len(batch.ops), ts))
+	for i, op := range batch.ops {
+		flags[i] = entry.FlagBatch
+		if op.delete {
+			flags[i] |= entry.FlagTombstone
+		} else {
+			value, codecFlags, err := bitcask.compressValue(op.value)
+			if err != nil {
+				return err
+			}
+			values[i] = value
+			flags[i] |= codecFlags
+		}
+		n += entry.EncodedLen(op.key, values[i]) + 2*crypter.overhead()
+	}
+
+	ends := make([]uint64, len(batch.ops))
+	err := bitcask.putLocked(ctx, n, func(fileID uint32, offset uint64) ([]byte, error) {
+		var buf []byte
+		for i, op := range batch.ops {
+			id, key, value, err := crypter.seal(fileID, offset+uint64(len(buf)), op.key, values[i])
+			if err != nil {
+				return nil, err
+			}
+			buf = append(buf, entry.Encode(key, value, ts, 0, seq+uint64(i)+1, flags[i]|entry.KeyIDFlags(id))...)
+			ends[i] = uint64(len(buf))
+		}
+		return append(buf, encodeCommit(len(batch.ops), ts)...), nil
+	})
+	if err != nil {
+		return err
+	}
+	bitcask.seq += uint64(len(batch.ops))
+	start := bitcask.offset - uint64(n)
+	for i, op := range batch.ops {
+		key := string(op.key)
+		bitcask.cache.remove(key)
+		if op.delete {
+			bitcask.keydir.Delete(key)
+			continue
+		}
+		valueSize := uint32(len(values[i]) + crypter.overhead())
+		entrySize := uint32(entry.EncodedLen(op.key, values[i]) + 2*crypter.overhead())
+		item := &item{
+			fileID:      bitcask.fileID,
+			valueSize:   valueSize,
+			valueOffset: start + ends[i] - uint64(valueSize),
+			entrySize:   entrySize,
+			timestamp:   ts,
+			version:     seq + uint64(i) + 1,
+		}
+		bitcask.keydir.Put(key, item)
+	}
+	return nil
+}
+
+// encodeCommit returns the commit record of a batch of n entries.
+func encodeCommit(n int, ts uint32) []byte {
+	value := make([]byte, 4)
+	binary.LittleEndian.PutUint32(value, uint32(n))
+	return entry.Encode(nil, value, ts, 0, 0, entry.FlagCommit)
+}
+
+// pendingBatch holds the entries of a batch read from a data file until
+// its commit record shows up.
+type pendingBatch struct {
+	fileID uint32
+	logger Logger
+
+	open    bool
+	start   uint64
+	entries []*entry.Entry
+	offsets []uint64
+}
+
+func (batch *pendingBatch) add(e *entry.Entry, offset uint64) {
+	if !batch.open {
+		batch.open = true
+		batch.start = offset
+	}
+	batch.entries = append(batch.entries, e)
+	batch.offsets = append(batch.offsets, offset)
+}
+
+// commit passes the entries of the batch to fn if none of them is missing.
+func (batch *pendingBatch) commit(e *entry.Entry, fn func(e *entry.Entry, offset uint64) error) error {
+	if !batch.open {
+		return nil
+	}
+	if len(e.Value) != 4 || binary.LittleEndian.Uint32(e.Value) != uint32(len(batch.entries)) {
+		batch.drop()
+		return nil
+	}
+	for i, e := range batch.entries {
+		if err := fn(e, batch.offsets[i]); err != nil {
+			return err
+		}
+	}
+	batch.reset()
+	return nil
+}
+
+// drop discards a batch that did not commit.
+func (batch *pendingBatch) drop() {
+	if !batch.open {
+		return
+	}
+	batch.logger.Printf("bitcask: uncommitted batch, fileID = %d, offset = %d, dropped %d entries", batch.fileID, batch.start, len(batch.entries))
+	batch.reset()
+}
+
+func (batch *pendingBatch) reset() {
+	batch.open = false
+	batch.entries = batch.entries[:0]
+	batch.offsets = batch.offsets[:0]
+}
@@ -0,0 +1,104 @@
+package bitcask
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrite(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithMaxFileSize(256))
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	err = bitcask.Put(ctx, []byte("deleted"), []byte("value"))
+	assert.Nil(t, err)
+
+	var batch Batch
+	n := 16
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		batch.Put([]byte(key), []byte(key))
+	}
+	batch.Delete([]byte("deleted"))
+	batch.Put([]byte("0"), []byte("latest"))
+	assert.Equal(t, batch.Len(), n+2)
+	err = bitcask.Write(ctx, &batch)
+	assert.Nil(t, err)
+
+	check := func() {
+		assert.Equal(t, bitcask.Len(), n)
+		for i := 1; i < n; i++ {
+			key := strconv.Itoa(i)
+			value, err := bitcask.Get(ctx, []byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, key, string(value))
+		}
+		value, err := bitcask.Get(ctx, []byte("0"))
+		assert.Nil(t, err)
+		assert.Equal(t, value, []byte("latest"))
+		value, err = bitcask.Get(ctx, []byte("deleted"))
+		assert.Nil(t, err)
+		assert.Nil(t, value)
+	}
+	check()
+
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	// open
+	bitcask, err = Open(dir, WithMaxFileSize(256))
+	assert.Nil(t, err)
+	check()
+
+	// merge
+	err = bitcask.Merge(ctx)
+	assert.Nil(t, err)
+	check()
+
+	err = bitcask.Close()
+	assert.Nil(t, err)
+}
+
+func TestWriteTorn(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir)
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	err = bitcask.Put(ctx, []byte("key"), []byte("value"))
+	assert.Nil(t, err)
+	offset := bitcask.offset
+
+	var batch Batch
+	batch.Put([]byte("key"), []byte("new"))
+	batch.Put([]byte("other"), []byte("value"))
+	err = bitcask.Write(ctx, &batch)
+	assert.Nil(t, err)
+	end := bitcask.offset
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	// a batch cut short by a crash before its commit record was written
+	err = os.Truncate(dataFilepath(dir, 1), int64(end)-1)
+	assert.Nil(t, err)
+
+	bitcask, err = Open(dir)
+	assert.Nil(t, err)
+	defer bitcask.Close()
+	assert.Equal(t, bitcask.Len(), 1)
+	assert.Equal(t, bitcask.offset, offset)
+
+	value, err := bitcask.Get(ctx, []byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, value, []byte("value"))
+	value, err = bitcask.Get(ctx, []byte("other"))
+	assert.Nil(t, err)
+	assert.Nil(t, value)
+}
@@ -1,38 +1,83 @@
 package bitcask
 
 import (
+	"bytes"
 	"context"
-	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"golang.org/x/sync/singleflight"
-
 	"github.com/decimalbell/bitcask/entry"
 )
 
 const (
 	dataFilenamePrefix = "bitcask.data."
 	hintFilenamePrefix = "bitcask.hint."
+	tmpFilenameSuffix  = ".tmp"
+	lockFilename       = "bitcask.lock"
 )
 
 type Bitcask struct {
+	// written is how much of the active file has been written, read by
+	// readers without holding mu. It comes first to be 64-bit aligned for
+	// atomic access.
+	written uint64
+
 	dir     string
 	options *Options
+	lock    *os.File
+
+	// closeMu is held shared by every operation and exclusively by Close,
+	// so Close waits for the operations in flight and later ones see
+	// closed.
+	closeMu sync.RWMutex
+	closed  bool
+
+	keydir keydir
+	rfiles *fileCache
+	cache  *valueCache
+
+	// wg tracks hint files being written and the syncer running in the
+	// background, which stops when done is closed.
+	wg   sync.WaitGroup
+	done chan struct{}
 
-	keydir *keydir
-	rfiles *sync.Map
+	mergeMu sync.Mutex
+
+	// pinMu guards pins, the number of snapshots reading each data file,
+	// and obsolete, the merged data files waiting for them in ascending
+	// order.
+	pinMu    sync.Mutex
+	pins     map[uint32]int
+	obsolete []uint32
 
 	mu     sync.Mutex
 	fileID uint32
 	file   *os.File
-	offset uint32
+	offset uint64
+	// pending holds the entries appended under SyncAlways that have yet to
+	// be written, which the next sync writes in one go. writeErr is the
+	// error of such a write, after which the keydir points at entries that
+	// are not in the file, so every later write fails with it.
+	pending  []byte
+	writeErr error
+	// seq is the sequence number of the last write.
+	seq uint64
+	// unsynced counts writes since the last sync for SyncEvery.
+	unsynced int
+
+	// syncMu serializes syncs of the active file. syncedFileID and
+	// syncedOffset tell how far it is known to be on disk.
+	syncMu       sync.Mutex
+	syncedFileID uint32
+	syncedOffset uint64
 }
 
 func Open(dir string, opts ...Option) (*Bitcask, error) {
@@ -45,72 +90,235 @@ func Open(dir string, opts ...Option) (*Bitcask, error) {
 }
 
 func open(dir string, options *Options) (*Bitcask, error) {
-	if err := os.MkdirAll(dir, 0744); err != nil {
+	if err := checkCodec(options.codec); err != nil {
 		return nil, err
 	}
-	file, err := os.Open(dir)
+	if !options.readOnly {
+		if err := os.MkdirAll(dir, 0744); err != nil {
+			return nil, err
+		}
+	}
+	lock, err := lockFile(dir, options.readOnly)
 	if err != nil {
 		return nil, err
 	}
-	names, err := file.Readdirnames(0)
+	bitcask, err := load(dir, options)
 	if err != nil {
+		unlockFile(lock)
 		return nil, err
 	}
-	sort.Strings(names)
+	bitcask.lock = lock
+	return bitcask, nil
+}
 
-	rfiles := new(sync.Map)
-	keydir := NewKeydir()
-	for _, name := range names {
-		fileID, err := dataFileID(name)
-		if err != nil {
+func load(dir string, options *Options) (*Bitcask, error) {
+	if !options.readOnly {
+		if err := removeStaleFiles(dir); err != nil {
 			return nil, err
 		}
-		file, err = loadDataFile(dir, name, fileID, keydir)
+	}
+	fileIDs, err := dataFileIDs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	rfiles := newFileCache(dir, options.maxOpenFiles)
+	keydir := NewKeydir()
+	if options.orderedKeydir {
+		keydir = NewOrderedKeydir()
+	}
+	var (
+		missingHints []uint32
+		seq          uint64
+		version      = entry.Version
+	)
+	for i, fileID := range fileIDs {
+		// The last data file is still being appended to and has no hint.
+		last := i == len(fileIDs)-1
+		if !last {
+			if n, err := loadHintFile(dir, fileID, keydir, options); err == nil {
+				seq = maxSeq(seq, n)
+				continue
+			}
+			missingHints = append(missingHints, fileID)
+		}
+		file, n, err := loadDataFile(dir, fileID, keydir, options, last)
 		if err != nil {
+			rfiles.close()
 			return nil, err
 		}
-		rfiles.Store(fileID, file)
+		seq = maxSeq(seq, n)
+		version = file.version
+		rfiles.put(fileID, file)
 	}
+	// Merges drop deleted keys along with their sequence numbers, so the
+	// highest one left may be lower than one handed out before. Starting
+	// from the clock keeps versions from being reused as long as there are
+	// fewer than a billion writes a second.
+	seq = maxSeq(seq, uint64(time.Now().UnixNano()))
 
 	var (
-		path   string
 		fileID uint32
-		offset uint32
+		offset uint64
 	)
-	if len(names) == 0 {
+	if len(fileIDs) == 0 {
 		fileID = 1
-		path = dataFilepath(dir, fileID)
 	} else {
-		name := names[len(names)-1]
-		fileID, _ = dataFileID(name)
-		path = filepath.Join(dir, name)
+		fileID = fileIDs[len(fileIDs)-1]
+		// Files of an older format are never appended to.
+		if version != entry.Version {
+			fileID += 1
+		}
 	}
 
-	flag := os.O_CREATE | os.O_APPEND | os.O_WRONLY
-	if options.syncOnPut {
-		flag |= os.O_SYNC
+	var file *os.File
+	if !options.readOnly {
+		file, err = openDataFile(dataFilepath(dir, fileID))
+		if err != nil {
+			rfiles.close()
+			return nil, err
+		}
+		fileInfo, err := file.Stat()
+		if err != nil {
+			file.Close()
+			rfiles.close()
+			return nil, err
+		}
+		offset = uint64(fileInfo.Size())
+		if offset == 0 {
+			if err := syncDir(dir); err != nil {
+				file.Close()
+				rfiles.close()
+				return nil, err
+			}
+		}
 	}
-	file, err = os.OpenFile(path, flag, 0644)
+
+	bitcask := &Bitcask{
+		dir:     dir,
+		options: options,
+		keydir:  keydir,
+
+		rfiles: rfiles,
+		cache:  newValueCache(options.cacheSize, options.cacheValueSize),
+		pins:   make(map[uint32]int),
+		done:   make(chan struct{}),
+
+		written: offset,
+		fileID:  fileID,
+		file:    file,
+		offset:  offset,
+		seq:     seq,
+	}
+	if !options.readOnly {
+		for _, fileID := range missingHints {
+			bitcask.writeHintFileAsync(fileID)
+		}
+		if options.syncPolicy.mode == syncInterval {
+			bitcask.syncPeriodically(options.syncPolicy.interval)
+		}
+	}
+	return bitcask, nil
+}
+
+// dataFile is a data file opened for reading. Once it is immutable, reads
+// may be served from a mapping of it into memory.
+type dataFile struct {
+	*os.File
+	fileID  uint32
+	version int
+
+	// data holds the mapping, a []byte, which reads of a file they took to
+	// be active load while another read maps it.
+	data atomic.Value
+	once sync.Once
+
+	// refs and evicted are guarded by the mutex of the fileCache.
+	refs    int
+	evicted bool
+}
+
+func openReadFile(path string) (*dataFile, error) {
+	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
-	fileInfo, err := file.Stat()
+	header := make([]byte, entry.FileHeaderSize)
+	n, err := file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		file.Close()
+		return nil, err
+	}
+	version, err := entry.FileVersion(header[:n])
 	if err != nil {
+		file.Close()
 		return nil, err
 	}
-	offset = uint32(fileInfo.Size())
+	return &dataFile{File: file, version: version}, nil
+}
 
-	return &Bitcask{
-		dir:     dir,
-		options: options,
-		keydir:  keydir,
+func openDataFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+}
 
-		rfiles: rfiles,
+// dataFileIDs returns the IDs of all data files in dir in ascending order.
+// Names that are not data files are ignored.
+func dataFileIDs(dir string) ([]uint32, error) {
+	names, err := readDirnames(dir)
+	if err != nil {
+		return nil, err
+	}
+	var fileIDs []uint32
+	for _, name := range names {
+		fileID, err := dataFileID(name)
+		if err != nil {
+			continue
+		}
+		fileIDs = append(fileIDs, fileID)
+	}
+	sort.Slice(fileIDs, func(i, j int) bool {
+		return fileIDs[i] < fileIDs[j]
+	})
+	return fileIDs, nil
+}
+
+// removeStaleFiles removes temporary files left behind by an unfinished
+// merge or hint write, and hint files whose data file has been merged away.
+func removeStaleFiles(dir string) error {
+	names, err := readDirnames(dir)
+	if err != nil {
+		return err
+	}
+	dataFiles := make(map[uint32]bool)
+	for _, name := range names {
+		if fileID, err := dataFileID(name); err == nil {
+			dataFiles[fileID] = true
+		}
+	}
+	for _, name := range names {
+		stale := strings.HasSuffix(name, tmpFilenameSuffix)
+		if fileID, err := hintFileID(name); err == nil && !dataFiles[fileID] {
+			stale = true
+		}
+		if !stale {
+			continue
+		}
+		// A file may be gone by the time it is removed, such as the
+		// temporary file of a hint write that has moved it into place.
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
 
-		fileID: fileID,
-		file:   file,
-		offset: offset,
-	}, nil
+func readDirnames(dir string) ([]string, error) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return file.Readdirnames(0)
 }
 
 func dataFileID(name string) (uint32, error) {
@@ -118,13 +326,12 @@ func dataFileID(name string) (uint32, error) {
 }
 
 func fileID(name, prefix string) (uint32, error) {
-	n := strings.Index(name, prefix)
-	if n != 0 {
-		return 0, fmt.Errorf("bitcask: invalid name, name = %s, prefix = %s", name, prefix)
+	if !strings.HasPrefix(name, prefix) {
+		return 0, errInvalidFilename
 	}
 	id, err := strconv.ParseUint(name[len(prefix):], 10, 32)
 	if err != nil {
-		return 0, err
+		return 0, errInvalidFilename
 	}
 	return uint32(id), nil
 }
@@ -134,157 +341,616 @@ func dataFilepath(dir string, fileID uint32) string {
 	return filepath.Join(dir, filename)
 }
 
-func loadDataFile(dir string, name string, fileID uint32, keydir *keydir) (*os.File, error) {
-	file, err := os.Open(filepath.Join(dir, name))
+func maxSeq(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// loadDataFile fills keydir from a data file and returns the highest
+// sequence number in it. If tail is set, the file is the one that was being
+// appended to, and a damaged last entry is taken to be a write that was cut
+// short by a crash: the file is truncated back to the end of the last
+// intact entry whatever the corruption policy.
+func loadDataFile(dir string, fileID uint32, keydir keydir, options *Options, tail bool) (*dataFile, uint64, error) {
+	path := dataFilepath(dir, fileID)
+	file, err := openReadFile(path)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	var seq uint64
+	now := uint32(time.Now().Unix())
+	end, err := scanDataFile(file.File, fileID, options, options.corruptionPolicy, tail, func(e *entry.Entry, offset uint64) error {
+		seq = maxSeq(seq, e.Seq)
+		key := string(e.Key)
+		// An expired entry still hides older values of its key.
+		if e.IsDeleted() || e.IsExpired(now) {
+			keydir.Delete(key)
+			return nil
+		}
+		item := &item{
+			fileID:      fileID,
+			valueSize:   e.ValueSize,
+			valueOffset: offset + uint64(e.Size()) - uint64(e.ValueSize),
+			entrySize:   uint32(e.Size()),
+			timestamp:   e.Timestamp,
+			expiry:      e.Expiry,
+			version:     e.Seq,
+		}
+		keydir.Put(key, item)
+		return nil
+	})
+	if err != nil {
+		file.Close()
+		return nil, 0, err
 	}
+	if (tail || options.corruptionPolicy == CorruptionTruncate) && !options.readOnly {
+		fileInfo, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, 0, err
+		}
+		if size := fileInfo.Size(); size > int64(end) {
+			options.logger.Printf("bitcask: truncating %s to %d bytes, dropped %d bytes", path, end, size-int64(end))
+			if err := os.Truncate(path, int64(end)); err != nil {
+				file.Close()
+				return nil, 0, err
+			}
+		}
+	}
+	return file, seq, nil
+}
+
+// scanDataFile calls fn with every intact entry of a data file and the
+// offset it starts at. Damaged entries are handled according to policy:
+// CorruptionFail returns a *CorruptedError, CorruptionSkip logs and skips
+// them and CorruptionTruncate stops at the first one. If tail is set, a
+// damaged entry that runs to the end of the file, with no intact entry
+// behind it, stops the scan whatever the policy. An entry claiming to run
+// past the end of the file is damaged too, and so is one over the key and
+// value size limits of options, which never passes for a torn write. The
+// entries of a batch are held back until its commit record is read, and
+// dropped if it is missing or the batch lost an entry.
+// scanDataFile returns the offset where the scanned data ends, which is
+// the start of a batch left uncommitted at the end of the file.
+func scanDataFile(file *os.File, fileID uint32, options *Options, policy CorruptionPolicy, tail bool, fn func(e *entry.Entry, offset uint64) error) (uint64, error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fileInfo.Size()
+	logger := options.logger
+
 	r := entry.NewReader(file)
-	var offset uint32
+	// The commit record of a batch holds a four byte count whatever the
+	// limit on values.
+	maxValueSize := sealedLimit(options.maxValueSize, options.crypter)
+	if maxValueSize > 0 && maxValueSize < 4 {
+		maxValueSize = 4
+	}
+	r.SetLimits(size, sealedLimit(options.maxKeySize, options.crypter), maxValueSize)
+	n, err := r.ReadFileHeader()
+	if err != nil {
+		return 0, err
+	}
+	offset := uint64(n)
+	batch := &pendingBatch{fileID: fileID, logger: logger}
+	end := func() uint64 {
+		if batch.open {
+			return batch.start
+		}
+		return offset
+	}
 	for {
-		entry, err := r.Read()
+		e, err := r.Read()
 		if err == io.EOF {
-			break
+			return end(), nil
 		}
 		if err != nil {
-			return nil, err
+			if tail && err == entry.ErrInvalidCRC && int64(offset)+int64(e.Size()) == size {
+				return end(), nil
+			}
+			// An entry claiming more bytes than are left is only a torn
+			// write if nothing intact follows it, as a damaged size field
+			// in the middle of the file looks just the same.
+			if tail && err == io.ErrUnexpectedEOF {
+				next, ferr := entry.Find(file, r.Version(), int64(offset)+1, size)
+				if ferr != nil {
+					return end(), ferr
+				}
+				if next < 0 {
+					return end(), nil
+				}
+			}
+			cerr := &CorruptedError{FileID: fileID, Offset: offset, Err: err}
+			switch policy {
+			case CorruptionSkip:
+				logger.Printf("%v, skipped", cerr)
+				if err == entry.ErrInvalidCRC {
+					offset += uint64(e.Size())
+					continue
+				}
+				return end(), nil
+			case CorruptionTruncate:
+				return end(), nil
+			default:
+				return end(), cerr
+			}
 		}
-		offset += uint32(entry.Size())
-		key := string(entry.Key)
-		if entry.IsDeleted() {
-			keydir.Delete(key)
-			continue
+		// An entry that fails to decrypt is intact, as its CRC shows, so it
+		// is down to a wrong key or tampering, which no policy covers.
+		if err := options.crypter.open(e, fileID, offset); err != nil {
+			return end(), &CorruptedError{FileID: fileID, Offset: offset, Err: err}
 		}
-		item := &item{
-			fileID:      fileID,
-			valueSize:   entry.ValueSize,
-			valueOffset: offset - entry.ValueSize,
-			timestamp:   entry.Timestamp,
+		switch {
+		case e.IsCommit():
+			err = batch.commit(e, fn)
+		case e.InBatch():
+			batch.add(e, offset)
+		default:
+			batch.drop()
+			err = fn(e, offset)
 		}
-		keydir.Put(key, item)
+		if err != nil {
+			return end(), err
+		}
+		offset += uint64(e.Size())
 	}
-	return file, nil
 }
 
+// sealedLimit returns the size limit of a stored key or value given the
+// limit on what is written, which encryption adds to.
+func sealedLimit(limit uint32, crypter *crypter) uint32 {
+	if limit == 0 {
+		return 0
+	}
+	return limit + uint32(crypter.overhead())
+}
+
+// Get returns the value of key, or nil if the key is missing or has
+// expired.
 func (bitcask *Bitcask) Get(ctx context.Context, key []byte) ([]byte, error) {
+	value, _, err := bitcask.GetWithVersion(ctx, key)
+	return value, err
+}
+
+// GetWithVersion returns the value of key along with its version, or nil
+// and zero if the key is missing or has expired. Every write to a key gives
+// it a higher version.
+func (bitcask *Bitcask) GetWithVersion(ctx context.Context, key []byte) ([]byte, uint64, error) {
+	value, item, err := bitcask.get(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if item == nil {
+		return nil, 0, bitcask.notFound()
+	}
+	return value, item.version, nil
+}
+
+// notFound returns the error for a missing key: ErrNotFound if the store
+// was opened WithErrNotFound and nil otherwise.
+func (bitcask *Bitcask) notFound() error {
+	if bitcask.options.errNotFound {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// checkSize returns ErrKeyTooLarge or ErrValueTooLarge if key or value is
+// over its configured limit, or an entry of them would not fit the entry
+// format.
+func (bitcask *Bitcask) checkSize(key, value []byte) error {
+	maxKeySize := bitcask.options.maxKeySize
+	if uint64(len(key)) > math.MaxUint32-entry.HeaderSize || (maxKeySize > 0 && uint64(len(key)) > uint64(maxKeySize)) {
+		return ErrKeyTooLarge
+	}
+	maxValueSize := bitcask.options.maxValueSize
+	if uint64(entry.EncodedLen(key, value)+2*bitcask.options.crypter.overhead()) > math.MaxUint32 || (maxValueSize > 0 && uint64(len(value)) > uint64(maxValueSize)) {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// get returns the value of key and the item it was read from, or nil for
+// both if the key is missing or has expired.
+func (bitcask *Bitcask) get(ctx context.Context, key []byte) ([]byte, *item, error) {
+	if err := bitcask.acquire(); err != nil {
+		return nil, nil, err
+	}
+	defer bitcask.release()
+
 	item, ok := bitcask.keydir.Get(string(key))
 	if !ok {
-		return nil, nil
+		return nil, nil, nil
 	}
 
-	var (
-		rfile interface{}
-		err   error
-	)
+	now := uint32(time.Now().Unix())
+	for {
+		if item.expired(now) {
+			return nil, nil, nil
+		}
+		value, err := bitcask.readValue(key, item)
+		if err == nil {
+			return value, item, nil
+		}
+		// A concurrent merge may have removed the data file after the item
+		// was looked up, in which case the keydir points at the new copy.
+		latest, ok := bitcask.keydir.Get(string(key))
+		if !ok {
+			return nil, nil, nil
+		}
+		if latest == item {
+			return nil, nil, err
+		}
+		item = latest
+	}
+}
 
-	rfile, ok = bitcask.rfiles.Load(item.fileID)
-	if !ok {
-		var group singleflight.Group
-		key := strconv.Itoa(int(item.fileID))
-		rfile, err, _ = group.Do(key, func() (interface{}, error) {
-			path := dataFilepath(bitcask.dir, item.fileID)
-			file, err := os.Open(path)
-			if err != nil {
-				return nil, err
-			}
-			bitcask.rfiles.Store(item.fileID, file)
-			return file, nil
-		})
-		if err != nil {
+// readValue reads the whole entry item points at and verifies it before
+// returning its value.
+func (bitcask *Bitcask) readValue(key []byte, item *item) ([]byte, error) {
+	if value, ok := bitcask.cache.get(key, item); ok {
+		return value, nil
+	}
+	// The entry may still wait in pending for a sync to write it.
+	if bitcask.coalescing() && item.fileID == atomic.LoadUint32(&bitcask.fileID) &&
+		item.valueOffset+uint64(item.valueSize) > atomic.LoadUint64(&bitcask.written) {
+		if err := bitcask.flush(); err != nil {
 			return nil, err
 		}
 	}
 
-	file := rfile.(*os.File)
-	value := make([]byte, int(item.valueSize))
-	if _, err := file.ReadAt(value, int64(item.valueOffset)); err != nil {
+	file, err := bitcask.rfiles.get(item.fileID)
+	if err != nil {
 		return nil, err
 	}
+	defer bitcask.rfiles.release(file)
 
+	// The active file is still growing, so it is read with ReadAt.
+	if bitcask.options.mmap && item.fileID != atomic.LoadUint32(&bitcask.fileID) {
+		if err := file.mmap(); err != nil {
+			bitcask.options.logger.Printf("bitcask: mmap failed, fileID = %d: %v", item.fileID, err)
+		}
+	}
+
+	offset := item.valueOffset + uint64(item.valueSize) - uint64(item.entrySize)
+	var value []byte
+	err = file.readAt(int64(offset), int(item.entrySize), func(buf []byte, mapped bool) error {
+		e, err := entry.Decode(buf, file.version)
+		if err == nil {
+			err = bitcask.options.crypter.open(e, item.fileID, offset)
+		}
+		if err == nil && !bytes.Equal(e.Key, key) {
+			err = entry.ErrInvalidCRC
+		}
+		if err == nil {
+			value, err = bitcask.decompressValue(e)
+		}
+		if err != nil {
+			return &CorruptedError{FileID: item.fileID, Offset: offset, Err: err}
+		}
+		// A value stored as is still points into the mapping.
+		if mapped && e.KeyID() == 0 && e.Codec() == 0 {
+			value = copyValue(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	bitcask.cache.put(key, item, value)
 	return value, nil
 }
 
 func (bitcask *Bitcask) Put(ctx context.Context, key, value []byte) error {
-	ts := uint32(time.Now().Unix())
-	buf := entry.Encode(key, value, ts)
+	return bitcask.put(ctx, key, value, 0, nil)
+}
 
-	bitcask.mu.Lock()
-	defer bitcask.mu.Unlock()
+// PutWithTTL sets the value of key to expire after ttl, rounded up to a
+// whole second. An expired key reads as missing, and its entry is dropped
+// on the next open or merge. Expiries are stored as 32-bit Unix times, so
+// one past early 2106 is cut to the last second that fits.
+func (bitcask *Bitcask) PutWithTTL(ctx context.Context, key, value []byte, ttl time.Duration) error {
+	deadline := time.Now().Add(ttl)
+	expiry := deadline.Unix()
+	if deadline.Nanosecond() > 0 {
+		expiry++
+	}
+	switch {
+	case expiry > math.MaxUint32:
+		expiry = math.MaxUint32
+	case expiry < 1:
+		// Zero stands for no expiry.
+		expiry = 1
+	}
+	return bitcask.put(ctx, key, value, uint32(expiry), nil)
+}
+
+// CompareAndSwap sets the value of key if its current version is
+// expectedVersion, where zero stands for a missing key. Otherwise it
+// returns a *ConflictError.
+func (bitcask *Bitcask) CompareAndSwap(ctx context.Context, key []byte, expectedVersion uint64, value []byte) error {
+	return bitcask.put(ctx, key, value, 0, func(version uint64) error {
+		if version != expectedVersion {
+			return &ConflictError{Key: key, Expected: expectedVersion, Actual: version}
+		}
+		return nil
+	})
+}
+
+// PutIfAbsent sets the value of key if the key is missing or has expired.
+// Otherwise it returns a *ConflictError.
+func (bitcask *Bitcask) PutIfAbsent(ctx context.Context, key, value []byte) error {
+	return bitcask.CompareAndSwap(ctx, key, 0, value)
+}
 
-	if err := bitcask.putLocked(ctx, buf); err != nil {
+// put writes key and value. If check is set, it is called under the write
+// lock with the current version of key, zero if it is missing, and its
+// error aborts the put.
+func (bitcask *Bitcask) put(ctx context.Context, key, value []byte, expiry uint32, check func(version uint64) error) error {
+	if err := bitcask.checkSize(key, value); err != nil {
 		return err
 	}
-	item := &item{
-		fileID:      bitcask.fileID,
-		valueSize:   uint32(len(value)),
-		valueOffset: bitcask.offset - uint32(len(value)),
-		timestamp:   ts,
+	value, flags, err := bitcask.compressValue(value)
+	if err != nil {
+		return err
 	}
-	bitcask.keydir.Put(string(key), item)
-	return nil
-}
+	ts := uint32(time.Now().Unix())
 
-func (bitcask *Bitcask) putLocked(ctx context.Context, buf []byte) error {
-	n := uint32(len(buf))
-	if bitcask.offset+n > bitcask.options.maxFileSize {
-		flag := os.O_CREATE | os.O_APPEND | os.O_WRONLY
-		if bitcask.options.syncOnPut {
-			flag |= os.O_SYNC
+	return bitcask.commit(func() error {
+		if check != nil {
+			if err := check(bitcask.versionLocked(key, ts)); err != nil {
+				return err
+			}
 		}
-		path := dataFilepath(bitcask.dir, bitcask.fileID+1)
-		file, err := os.OpenFile(path, flag, 0644)
+		seq := bitcask.seq + 1
+		crypter := bitcask.options.crypter
+		n := entry.EncodedLen(key, value) + 2*crypter.overhead()
+		err := bitcask.putLocked(ctx, n, func(fileID uint32, offset uint64) ([]byte, error) {
+			id, skey, svalue, err := crypter.seal(fileID, offset, key, value)
+			if err != nil {
+				return nil, err
+			}
+			return entry.Encode(skey, svalue, ts, expiry, seq, flags|entry.KeyIDFlags(id)), nil
+		})
 		if err != nil {
 			return err
 		}
-		bitcask.file = file
-		bitcask.fileID += 1
-		bitcask.offset = 0
+		bitcask.seq = seq
+		valueSize := len(value) + crypter.overhead()
+		item := &item{
+			fileID:      bitcask.fileID,
+			valueSize:   uint32(valueSize),
+			valueOffset: bitcask.offset - uint64(valueSize),
+			entrySize:   uint32(n),
+			timestamp:   ts,
+			expiry:      expiry,
+			version:     seq,
+		}
+		bitcask.keydir.Put(string(key), item)
+		bitcask.cache.remove(string(key))
+		return nil
+	})
+}
+
+// versionLocked returns the version of key at now, or zero if it is
+// missing or has expired. Writes cannot change it while mu is held.
+func (bitcask *Bitcask) versionLocked(key []byte, now uint32) uint64 {
+	item, ok := bitcask.keydir.Get(string(key))
+	if !ok || item.expired(now) {
+		return 0
+	}
+	return item.version
+}
+
+// putLocked appends n bytes built by encode, which is given the data file
+// and offset they are written at.
+func (bitcask *Bitcask) putLocked(ctx context.Context, n int, encode func(fileID uint32, offset uint64) ([]byte, error)) error {
+	if bitcask.options.readOnly {
+		return ErrReadOnly
+	}
+	if bitcask.writeErr != nil {
+		return bitcask.writeErr
+	}
+	if bitcask.offset > 0 && bitcask.offset+uint64(n) > bitcask.options.maxFileSize {
+		fileID := bitcask.fileID
+		if err := bitcask.rotateLocked(fileID + 1); err != nil {
+			return err
+		}
+		bitcask.writeHintFileAsync(fileID)
 	}
 
+	var header []byte
+	if bitcask.offset == 0 {
+		header = entry.EncodeFileHeader()
+	}
+	buf, err := encode(bitcask.fileID, bitcask.offset+uint64(len(header)))
+	if err != nil {
+		return err
+	}
+	if header != nil {
+		buf = append(header, buf...)
+	}
+	if bitcask.coalescing() {
+		// Writers that sync leave their entries to the sync they wait for,
+		// so those appended while another sync runs share a single write.
+		bitcask.pending = append(bitcask.pending, buf...)
+		bitcask.offset += uint64(len(buf))
+		return nil
+	}
 	if _, err := bitcask.file.Write(buf); err != nil {
 		return err
 	}
-	bitcask.offset += n
+	bitcask.offset += uint64(len(buf))
+	atomic.StoreUint64(&bitcask.written, bitcask.offset)
 	return nil
 }
 
-func (bitcask *Bitcask) Delete(ctx context.Context, key []byte) error {
-	ts := uint32(time.Now().Unix())
-	buf := entry.Encode(key, []byte{}, ts)
+// coalescing reports whether writes are appended to pending rather than
+// written right away.
+func (bitcask *Bitcask) coalescing() bool {
+	return bitcask.options.syncPolicy.mode == syncAlways && !bitcask.options.readOnly
+}
 
+// flush writes the pending entries to the active file.
+func (bitcask *Bitcask) flush() error {
 	bitcask.mu.Lock()
 	defer bitcask.mu.Unlock()
+	return bitcask.flushLocked()
+}
+
+func (bitcask *Bitcask) flushLocked() error {
+	if bitcask.writeErr != nil {
+		return bitcask.writeErr
+	}
+	if len(bitcask.pending) == 0 {
+		return nil
+	}
+	_, err := bitcask.file.Write(bitcask.pending)
+	bitcask.pending = bitcask.pending[:0]
+	if err != nil {
+		bitcask.writeErr = err
+		return err
+	}
+	atomic.StoreUint64(&bitcask.written, bitcask.offset)
+	return nil
+}
 
-	if err := bitcask.putLocked(ctx, buf); err != nil {
+// rotateLocked closes the active file and starts appending to a new data
+// file with the given ID.
+func (bitcask *Bitcask) rotateLocked(fileID uint32) error {
+	if err := bitcask.flushLocked(); err != nil {
+		return err
+	}
+	file, err := openDataFile(dataFilepath(bitcask.dir, fileID))
+	if err != nil {
+		return err
+	}
+	// The new file must survive a power loss along with what is written
+	// to it.
+	if err := syncDir(bitcask.dir); err != nil {
+		file.Close()
+		return err
+	}
+	if err := bitcask.file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := bitcask.file.Close(); err != nil {
+		file.Close()
 		return err
 	}
-	bitcask.keydir.Delete(string(key))
+	bitcask.file = file
+	// readValue reads fileID and written without holding mu.
+	atomic.StoreUint32(&bitcask.fileID, fileID)
+	atomic.StoreUint64(&bitcask.written, 0)
+	bitcask.offset = 0
 	return nil
 }
 
+func (bitcask *Bitcask) Delete(ctx context.Context, key []byte) error {
+	if err := bitcask.checkSize(key, nil); err != nil {
+		return err
+	}
+	ts := uint32(time.Now().Unix())
+
+	return bitcask.commit(func() error {
+		seq := bitcask.seq + 1
+		crypter := bitcask.options.crypter
+		n := entry.EncodedLen(key, nil) + 2*crypter.overhead()
+		err := bitcask.putLocked(ctx, n, func(fileID uint32, offset uint64) ([]byte, error) {
+			id, skey, svalue, err := crypter.seal(fileID, offset, key, nil)
+			if err != nil {
+				return nil, err
+			}
+			return entry.Encode(skey, svalue, ts, 0, seq, entry.FlagTombstone|entry.KeyIDFlags(id)), nil
+		})
+		if err != nil {
+			return err
+		}
+		bitcask.seq = seq
+		bitcask.keydir.Delete(string(key))
+		bitcask.cache.remove(string(key))
+		return nil
+	})
+}
+
+// Len returns the number of keys, including expired keys that have not
+// been dropped yet.
 func (bitcask *Bitcask) Len() int {
 	return bitcask.keydir.Len()
 }
 
+// Sync flushes everything written so far to disk.
 func (bitcask *Bitcask) Sync() error {
+	if err := bitcask.acquire(); err != nil {
+		return err
+	}
+	defer bitcask.release()
+
 	bitcask.mu.Lock()
-	defer bitcask.mu.Unlock()
+	file, fileID, offset := bitcask.file, bitcask.fileID, bitcask.offset
+	bitcask.mu.Unlock()
 
-	if bitcask.file == nil {
+	if file == nil {
 		return nil
 	}
-	return bitcask.file.Sync()
+	return bitcask.syncTo(fileID, offset)
+}
+
+// acquire registers an operation in flight, or returns ErrClosed if the
+// store has been closed. Every successful acquire must be followed by a
+// release.
+func (bitcask *Bitcask) acquire() error {
+	bitcask.closeMu.RLock()
+	if bitcask.closed {
+		bitcask.closeMu.RUnlock()
+		return ErrClosed
+	}
+	return nil
 }
 
+func (bitcask *Bitcask) release() {
+	bitcask.closeMu.RUnlock()
+}
+
+// Close waits for the operations in flight, stops the background
+// goroutines, syncs and closes the active file and every read handle and
+// releases the directory lock. Operations called after Close return
+// ErrClosed. Closing a closed store does nothing.
 func (bitcask *Bitcask) Close() error {
+	bitcask.closeMu.Lock()
+	closed := bitcask.closed
+	bitcask.closed = true
+	bitcask.closeMu.Unlock()
+	if closed {
+		return nil
+	}
+
+	close(bitcask.done)
+	bitcask.wg.Wait()
+
 	bitcask.mu.Lock()
 	defer bitcask.mu.Unlock()
 
-	if bitcask.file == nil {
-		return nil
+	var err error
+	// A read-only store has no active file.
+	if bitcask.file != nil {
+		err = bitcask.flushLocked()
+		if serr := bitcask.file.Sync(); err == nil {
+			err = serr
+		}
+		if cerr := bitcask.file.Close(); err == nil {
+			err = cerr
+		}
 	}
-	if err := bitcask.file.Sync(); err != nil {
-		return err
+	if cerr := bitcask.rfiles.close(); err == nil {
+		err = cerr
+	}
+	if uerr := unlockFile(bitcask.lock); err == nil {
+		err = uerr
 	}
-	return bitcask.file.Close()
+	return err
 }
@@ -2,27 +2,28 @@ package bitcask
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/decimalbell/bitcask/entry"
 )
 
 var (
 	dir = os.TempDir() + "bitcask"
 )
 
-func syncMapLen(m *sync.Map) int {
-	len := 0
-	m.Range(func(key, value interface{}) bool {
-		len += 1
-		return true
-	})
-	return len
-}
-
 func TestOpenEmptyDir(t *testing.T) {
 	defer os.RemoveAll(dir)
 
@@ -30,7 +31,7 @@ func TestOpenEmptyDir(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotNil(t, bitcask)
 
-	assert.EqualValues(t, syncMapLen(bitcask.rfiles), 0)
+	assert.EqualValues(t, bitcask.rfiles.len(), 0)
 	assert.EqualValues(t, bitcask.keydir.Len(), 0)
 	assert.NotNil(t, bitcask.file)
 	assert.EqualValues(t, bitcask.fileID, 1)
@@ -44,7 +45,7 @@ func TestOpenOneFileDir(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotNil(t, bitcask)
 
-	assert.EqualValues(t, syncMapLen(bitcask.rfiles), 0)
+	assert.EqualValues(t, bitcask.rfiles.len(), 0)
 	assert.EqualValues(t, bitcask.keydir.Len(), 0)
 	assert.NotNil(t, bitcask.file)
 	assert.EqualValues(t, bitcask.fileID, 1)
@@ -68,7 +69,7 @@ func TestOpenOneFileDir(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotNil(t, bitcask)
 
-	assert.EqualValues(t, syncMapLen(bitcask.rfiles), 1)
+	assert.EqualValues(t, bitcask.rfiles.len(), 1)
 	assert.Equal(t, bitcask.keydir.Len(), n)
 	assert.NotNil(t, bitcask.file)
 	assert.EqualValues(t, bitcask.fileID, 1)
@@ -96,7 +97,7 @@ func TestOpenOneFileDir(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotNil(t, bitcask)
 
-	assert.EqualValues(t, syncMapLen(bitcask.rfiles), 1)
+	assert.EqualValues(t, bitcask.rfiles.len(), 1)
 	assert.Equal(t, bitcask.keydir.Len(), n-m)
 	assert.NotNil(t, bitcask.file)
 	assert.EqualValues(t, bitcask.fileID, 1)
@@ -133,12 +134,12 @@ func TestPut1(t *testing.T) {
 	assert.Equal(t, err, nil)
 	assert.EqualValues(t, bitcask.fileID, 1)
 	assert.NotNil(t, bitcask.file)
-	assert.EqualValues(t, bitcask.offset, 16+len(key)+len(value))
+	assert.EqualValues(t, bitcask.offset, entry.FileHeaderSize+entry.HeaderSize+len(key)+len(value))
 
 	v, err := bitcask.Get(ctx, key)
 	assert.Equal(t, err, nil)
 	assert.Equal(t, v, value)
-	assert.Equal(t, syncMapLen(bitcask.rfiles), 1)
+	assert.Equal(t, bitcask.rfiles.len(), 1)
 }
 
 func TestPut2(t *testing.T) {
@@ -146,6 +147,7 @@ func TestPut2(t *testing.T) {
 
 	bitcask, err := Open(dir, WithMaxFileSize(32))
 	assert.Equal(t, err, nil)
+	defer bitcask.Close()
 
 	key := []byte("key")
 	value := []byte("value")
@@ -156,24 +158,24 @@ func TestPut2(t *testing.T) {
 	assert.Equal(t, err, nil)
 	assert.EqualValues(t, bitcask.fileID, 1)
 	assert.NotNil(t, bitcask.file)
-	assert.EqualValues(t, bitcask.offset, 16+len(key)+len(value))
+	assert.EqualValues(t, bitcask.offset, entry.FileHeaderSize+entry.HeaderSize+len(key)+len(value))
 
 	v, err := bitcask.Get(ctx, key)
 	assert.Equal(t, err, nil)
 	assert.Equal(t, v, value)
-	assert.Equal(t, syncMapLen(bitcask.rfiles), 1)
+	assert.Equal(t, bitcask.rfiles.len(), 1)
 
 	// put key value
 	err = bitcask.Put(ctx, key, value)
 	assert.Equal(t, err, nil)
 	assert.EqualValues(t, bitcask.fileID, 2)
 	assert.NotNil(t, bitcask.file)
-	assert.EqualValues(t, bitcask.offset, 16+len(key)+len(value))
+	assert.EqualValues(t, bitcask.offset, entry.FileHeaderSize+entry.HeaderSize+len(key)+len(value))
 
 	v, err = bitcask.Get(ctx, key)
 	assert.Equal(t, err, nil)
 	assert.Equal(t, v, value)
-	assert.Equal(t, syncMapLen(bitcask.rfiles), 2)
+	assert.Equal(t, bitcask.rfiles.len(), 2)
 }
 
 func TestGetMiss(t *testing.T) {
@@ -188,7 +190,7 @@ func TestGetMiss(t *testing.T) {
 	v, err := bitcask.Get(ctx, key)
 	assert.Nil(t, err)
 	assert.Nil(t, v)
-	assert.Equal(t, syncMapLen(bitcask.rfiles), 0)
+	assert.Equal(t, bitcask.rfiles.len(), 0)
 }
 
 func TestGetHit(t *testing.T) {
@@ -196,6 +198,7 @@ func TestGetHit(t *testing.T) {
 
 	bitcask, err := Open(dir)
 	assert.Equal(t, err, nil)
+	defer bitcask.Close()
 
 	key := []byte("key")
 	value := []byte("value")
@@ -204,7 +207,7 @@ func TestGetHit(t *testing.T) {
 	v, err := bitcask.Get(ctx, key)
 	assert.Nil(t, err)
 	assert.Nil(t, v)
-	assert.Equal(t, syncMapLen(bitcask.rfiles), 0)
+	assert.Equal(t, bitcask.rfiles.len(), 0)
 
 	err = bitcask.Put(ctx, key, value)
 	assert.Equal(t, err, nil)
@@ -212,7 +215,7 @@ func TestGetHit(t *testing.T) {
 	v, err = bitcask.Get(ctx, key)
 	assert.Nil(t, err)
 	assert.Equal(t, v, value)
-	assert.Equal(t, syncMapLen(bitcask.rfiles), 1)
+	assert.Equal(t, bitcask.rfiles.len(), 1)
 }
 
 func TestDelete(t *testing.T) {
@@ -299,6 +302,29 @@ func BenchmarkPutParallel(b *testing.B) {
 	})
 }
 
+func BenchmarkPutParallelSync(b *testing.B) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithSyncOnPut(true))
+	if err != nil {
+		panic(err)
+	}
+	defer bitcask.Close()
+
+	key := []byte("key")
+	value := []byte("value")
+
+	ctx := context.Background()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := bitcask.Put(ctx, key, value); err != nil {
+				panic(err)
+			}
+		}
+	})
+}
+
 func BenchmarkGet(b *testing.B) {
 	defer os.RemoveAll(dir)
 
@@ -348,3 +374,817 @@ func BenchmarkGetParallel(b *testing.B) {
 		}
 	})
 }
+
+func corruptDataFile(t *testing.T, fileID uint32, offset int64) {
+	file, err := os.OpenFile(dataFilepath(dir, fileID), os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	defer file.Close()
+
+	b := make([]byte, 1)
+	_, err = file.ReadAt(b, offset)
+	assert.Nil(t, err)
+	b[0] ^= 0xff
+	_, err = file.WriteAt(b, offset)
+	assert.Nil(t, err)
+}
+
+func TestGetCorrupted(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir)
+	assert.Nil(t, err)
+
+	key := []byte("key")
+	value := []byte("value")
+
+	ctx := context.Background()
+	err = bitcask.Put(ctx, key, value)
+	assert.Nil(t, err)
+
+	corruptDataFile(t, 1, int64(bitcask.offset)-1)
+
+	v, err := bitcask.Get(ctx, key)
+	assert.Nil(t, v)
+	assert.True(t, errors.Is(err, ErrCorrupted))
+	var cerr *CorruptedError
+	assert.True(t, errors.As(err, &cerr))
+	assert.EqualValues(t, cerr.FileID, 1)
+	assert.EqualValues(t, cerr.Offset, entry.FileHeaderSize)
+}
+
+func TestOpenCorrupted(t *testing.T) {
+	size := entry.HeaderSize + 1 + 1
+
+	tests := []struct {
+		policy CorruptionPolicy
+		keys   []string
+		size   int64
+		fail   bool
+	}{
+		{policy: CorruptionFail, fail: true},
+		{policy: CorruptionSkip, keys: []string{"0", "2"}, size: int64(entry.FileHeaderSize + 3*size)},
+		{policy: CorruptionTruncate, keys: []string{"0"}, size: int64(entry.FileHeaderSize + size)},
+	}
+	for _, test := range tests {
+		bitcask, err := Open(dir)
+		assert.Nil(t, err)
+
+		ctx := context.Background()
+		for i := 0; i < 3; i++ {
+			key := strconv.Itoa(i)
+			err = bitcask.Put(ctx, []byte(key), []byte(key))
+			assert.Nil(t, err)
+		}
+		err = bitcask.Close()
+		assert.Nil(t, err)
+
+		corruptDataFile(t, 1, int64(entry.FileHeaderSize+2*size-1))
+
+		bitcask, err = Open(dir, WithCorruptionPolicy(test.policy))
+		if test.fail {
+			assert.True(t, errors.Is(err, ErrCorrupted))
+			os.RemoveAll(dir)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, bitcask.Len(), len(test.keys))
+		for _, key := range test.keys {
+			value, err := bitcask.Get(ctx, []byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, key, string(value))
+		}
+		assert.EqualValues(t, bitcask.offset, test.size)
+		err = bitcask.Close()
+		assert.Nil(t, err)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestOpenTornTail(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir)
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	n := 3
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		err = bitcask.Put(ctx, []byte(key), []byte(key))
+		assert.Nil(t, err)
+	}
+	offset := bitcask.offset
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	// a put cut short by a crash
+	file, err := os.OpenFile(dataFilepath(dir, 1), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write(entry.Encode([]byte("key"), []byte("value"), 0, 0, 0, 0)[:entry.HeaderSize])
+	assert.Nil(t, err)
+	err = file.Close()
+	assert.Nil(t, err)
+
+	bitcask, err = Open(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, bitcask.Len(), n)
+	assert.Equal(t, bitcask.offset, offset)
+
+	err = bitcask.Put(ctx, []byte("key"), []byte("value"))
+	assert.Nil(t, err)
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	// a put with a damaged last byte
+	corruptDataFile(t, 1, int64(bitcask.offset)-1)
+
+	bitcask, err = Open(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, bitcask.Len(), n)
+	assert.Equal(t, bitcask.offset, offset)
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		value, err := bitcask.Get(ctx, []byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, key, string(value))
+	}
+}
+
+func TestOpenCorruptedSize(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir)
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	n := 100
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		err = bitcask.Put(ctx, []byte(key), []byte(key))
+		assert.Nil(t, err)
+	}
+	item, ok := bitcask.keydir.Get("10")
+	assert.True(t, ok)
+	offset := int64(item.valueOffset) + int64(item.valueSize) - int64(item.entrySize)
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	// a value size in the middle of the file pointing past its end
+	file, err := os.OpenFile(dataFilepath(dir, 1), os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, 1<<30)
+	_, err = file.WriteAt(b, offset+12)
+	assert.Nil(t, err)
+	err = file.Close()
+	assert.Nil(t, err)
+
+	_, err = Open(dir)
+	assert.True(t, errors.Is(err, ErrCorrupted))
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+
+	bitcask, err = Open(dir, WithCorruptionPolicy(CorruptionTruncate))
+	assert.Nil(t, err)
+	defer bitcask.Close()
+	assert.Equal(t, bitcask.Len(), 10)
+}
+
+func TestPutEmptyValue(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir)
+	assert.Nil(t, err)
+
+	key := []byte("key")
+
+	ctx := context.Background()
+	err = bitcask.Put(ctx, key, []byte{})
+	assert.Nil(t, err)
+
+	v, err := bitcask.Get(ctx, key)
+	assert.Nil(t, err)
+	assert.NotNil(t, v)
+	assert.Equal(t, len(v), 0)
+
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	// open
+	bitcask, err = Open(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, bitcask.Len(), 1)
+
+	v, err = bitcask.Get(ctx, key)
+	assert.Nil(t, err)
+	assert.NotNil(t, v)
+	assert.Equal(t, len(v), 0)
+}
+
+// encodeV1 encodes an entry with the 16 byte header of Version1 files.
+func encodeV1(key, value []byte, ts uint32) []byte {
+	buf := make([]byte, entry.HeaderSizeV1+len(key)+len(value))
+	binary.LittleEndian.PutUint32(buf[4:], ts)
+	binary.LittleEndian.PutUint32(buf[8:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(buf[12:], uint32(len(value)))
+	copy(buf[entry.HeaderSizeV1:], key)
+	copy(buf[entry.HeaderSizeV1+len(key):], value)
+	binary.LittleEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+func TestOpenVersion1(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	err := os.MkdirAll(dir, 0744)
+	assert.Nil(t, err)
+	var buf []byte
+	buf = append(buf, encodeV1([]byte("a"), []byte("1"), 0)...)
+	buf = append(buf, encodeV1([]byte("b"), []byte("2"), 0)...)
+	buf = append(buf, encodeV1([]byte("a"), nil, 0)...)
+	err = ioutil.WriteFile(dataFilepath(dir, 1), buf, 0644)
+	assert.Nil(t, err)
+
+	bitcask, err := Open(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, bitcask.Len(), 1)
+	assert.EqualValues(t, bitcask.fileID, 2)
+
+	ctx := context.Background()
+	v, err := bitcask.Get(ctx, []byte("b"))
+	assert.Nil(t, err)
+	assert.Equal(t, string(v), "2")
+
+	err = bitcask.Put(ctx, []byte("c"), []byte("3"))
+	assert.Nil(t, err)
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	// open
+	bitcask, err = Open(dir)
+	assert.Nil(t, err)
+	defer bitcask.Close()
+	assert.Equal(t, bitcask.Len(), 2)
+	assert.EqualValues(t, bitcask.fileID, 2)
+	for key, value := range map[string]string{"b": "2", "c": "3"} {
+		v, err := bitcask.Get(ctx, []byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, string(v), value)
+	}
+}
+
+func TestOpenLocked(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir)
+	assert.Nil(t, err)
+
+	_, err = Open(dir)
+	assert.Equal(t, err, ErrLocked)
+
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	bitcask, err = Open(dir)
+	assert.Nil(t, err)
+	err = bitcask.Close()
+	assert.Nil(t, err)
+}
+
+func TestPutWithTTL(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir)
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	err = bitcask.Put(ctx, []byte("expired"), []byte("old"))
+	assert.Nil(t, err)
+	err = bitcask.PutWithTTL(ctx, []byte("expired"), []byte("value"), -time.Second)
+	assert.Nil(t, err)
+	err = bitcask.PutWithTTL(ctx, []byte("live"), []byte("value"), time.Hour)
+	assert.Nil(t, err)
+
+	check := func() {
+		v, err := bitcask.Get(ctx, []byte("expired"))
+		assert.Nil(t, err)
+		assert.Nil(t, v)
+		v, err = bitcask.Get(ctx, []byte("live"))
+		assert.Nil(t, err)
+		assert.Equal(t, v, []byte("value"))
+		keys, err := bitcask.Keys(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, keys, [][]byte{[]byte("live")})
+	}
+	check()
+
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	// open
+	bitcask, err = Open(dir)
+	assert.Nil(t, err)
+	defer bitcask.Close()
+	assert.Equal(t, bitcask.Len(), 1)
+	check()
+}
+
+func TestPutWithTTLOverflow(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir)
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	ctx := context.Background()
+	years := 200 * 365 * 24 * time.Hour
+	err = bitcask.PutWithTTL(ctx, []byte("live"), []byte("value"), years)
+	assert.Nil(t, err)
+	err = bitcask.PutWithTTL(ctx, []byte("expired"), []byte("value"), -years)
+	assert.Nil(t, err)
+
+	item, ok := bitcask.keydir.Get("live")
+	assert.True(t, ok)
+	assert.EqualValues(t, item.expiry, uint32(math.MaxUint32))
+	v, err := bitcask.Get(ctx, []byte("live"))
+	assert.Nil(t, err)
+	assert.Equal(t, v, []byte("value"))
+	v, err = bitcask.Get(ctx, []byte("expired"))
+	assert.Nil(t, err)
+	assert.Nil(t, v)
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir)
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	key := []byte("key")
+
+	err = bitcask.PutIfAbsent(ctx, key, []byte("1"))
+	assert.Nil(t, err)
+	err = bitcask.PutIfAbsent(ctx, key, []byte("2"))
+	assert.True(t, errors.Is(err, ErrConflict))
+
+	value, version, err := bitcask.GetWithVersion(ctx, key)
+	assert.Nil(t, err)
+	assert.Equal(t, value, []byte("1"))
+	assert.NotZero(t, version)
+
+	err = bitcask.CompareAndSwap(ctx, key, version, []byte("2"))
+	assert.Nil(t, err)
+	err = bitcask.CompareAndSwap(ctx, key, version, []byte("3"))
+	var cerr *ConflictError
+	assert.True(t, errors.As(err, &cerr))
+	assert.Equal(t, cerr.Expected, version)
+	assert.True(t, cerr.Actual > version)
+	version = cerr.Actual
+
+	err = bitcask.Merge(ctx)
+	assert.Nil(t, err)
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	// open
+	bitcask, err = Open(dir)
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	value, v, err := bitcask.GetWithVersion(ctx, key)
+	assert.Nil(t, err)
+	assert.Equal(t, value, []byte("2"))
+	assert.Equal(t, v, version)
+
+	err = bitcask.Delete(ctx, key)
+	assert.Nil(t, err)
+	value, v, err = bitcask.GetWithVersion(ctx, key)
+	assert.Nil(t, err)
+	assert.Nil(t, value)
+	assert.Zero(t, v)
+	err = bitcask.CompareAndSwap(ctx, key, 0, []byte("3"))
+	assert.Nil(t, err)
+	_, v, err = bitcask.GetWithVersion(ctx, key)
+	assert.Nil(t, err)
+	assert.True(t, v > version)
+}
+
+func TestCompareAndSwapConcurrent(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir)
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	ctx := context.Background()
+	key := []byte("counter")
+	n := 8
+	m := 64
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < m; {
+				value, version, err := bitcask.GetWithVersion(ctx, key)
+				assert.Nil(t, err)
+				count, _ := strconv.Atoi(string(value))
+				err = bitcask.CompareAndSwap(ctx, key, version, []byte(strconv.Itoa(count+1)))
+				if errors.Is(err, ErrConflict) {
+					continue
+				}
+				assert.Nil(t, err)
+				j++
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := bitcask.Get(ctx, key)
+	assert.Nil(t, err)
+	assert.Equal(t, string(value), strconv.Itoa(n*m))
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	_, err := Open(dir, WithReadOnly(true))
+	assert.True(t, os.IsNotExist(err))
+
+	bitcask, err := Open(dir, WithMaxFileSize(64))
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	n := 8
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		err = bitcask.Put(ctx, []byte(key), []byte(key))
+		assert.Nil(t, err)
+	}
+
+	_, err = Open(dir, WithReadOnly(true))
+	assert.Equal(t, err, ErrLocked)
+
+	fileID := bitcask.fileID
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	// a put cut short by a crash is left alone
+	file, err := os.OpenFile(dataFilepath(dir, fileID), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write(entry.Encode([]byte("key"), []byte("value"), 0, 0, 0, 0)[:entry.HeaderSize])
+	assert.Nil(t, err)
+	err = file.Close()
+	assert.Nil(t, err)
+
+	names, err := readDirnames(dir)
+	assert.Nil(t, err)
+	sizes := make(map[string]int64)
+	for _, name := range names {
+		fileInfo, err := os.Stat(filepath.Join(dir, name))
+		assert.Nil(t, err)
+		sizes[name] = fileInfo.Size()
+	}
+
+	bitcask1, err := Open(dir, WithReadOnly(true))
+	assert.Nil(t, err)
+	bitcask2, err := Open(dir, WithReadOnly(true))
+	assert.Nil(t, err)
+
+	_, err = Open(dir)
+	assert.Equal(t, err, ErrLocked)
+
+	assert.Equal(t, bitcask1.Len(), n)
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		value, err := bitcask1.Get(ctx, []byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, key, string(value))
+	}
+	assert.Equal(t, bitcask1.Put(ctx, []byte("key"), []byte("value")), ErrReadOnly)
+	assert.Equal(t, bitcask1.Delete(ctx, []byte("0")), ErrReadOnly)
+	assert.Equal(t, bitcask1.Merge(ctx), ErrReadOnly)
+
+	err = bitcask1.Close()
+	assert.Nil(t, err)
+	err = bitcask2.Close()
+	assert.Nil(t, err)
+
+	names, err = readDirnames(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, len(names), len(sizes))
+	for _, name := range names {
+		fileInfo, err := os.Stat(filepath.Join(dir, name))
+		assert.Nil(t, err)
+		assert.Equal(t, fileInfo.Size(), sizes[name])
+	}
+}
+
+func TestSyncOnPutConcurrent(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithSyncOnPut(true), WithMaxFileSize(1024))
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	n := 8
+	m := 64
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < m; j++ {
+				key := strconv.Itoa(i*m + j)
+				err := bitcask.Put(ctx, []byte(key), []byte(key))
+				assert.Nil(t, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	bitcask.mu.Lock()
+	assert.Equal(t, bitcask.syncedFileID, bitcask.fileID)
+	assert.Equal(t, bitcask.syncedOffset, bitcask.offset)
+	bitcask.mu.Unlock()
+
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	// open
+	bitcask, err = Open(dir)
+	assert.Nil(t, err)
+	defer bitcask.Close()
+	assert.Equal(t, bitcask.Len(), n*m)
+	for i := 0; i < n*m; i++ {
+		key := strconv.Itoa(i)
+		value, err := bitcask.Get(ctx, []byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, key, string(value))
+	}
+}
+
+func TestSyncOnPutCoalesced(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithSyncOnPut(true))
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	// writers appending while a sync runs wait for the next one
+	bitcask.syncMu.Lock()
+	ctx := context.Background()
+	n := 8
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := strconv.Itoa(i)
+			err := bitcask.Put(ctx, []byte(key), []byte(key))
+			assert.Nil(t, err)
+		}(i)
+	}
+	for bitcask.Len() < n {
+		time.Sleep(time.Millisecond)
+	}
+	bitcask.mu.Lock()
+	assert.EqualValues(t, len(bitcask.pending), bitcask.offset)
+	bitcask.mu.Unlock()
+	fileInfo, err := os.Stat(dataFilepath(dir, 1))
+	assert.Nil(t, err)
+	assert.EqualValues(t, fileInfo.Size(), 0)
+
+	// reads write the entries they need
+	value, err := bitcask.Get(ctx, []byte("0"))
+	assert.Nil(t, err)
+	assert.Equal(t, "0", string(value))
+	bitcask.mu.Lock()
+	assert.Equal(t, len(bitcask.pending), 0)
+	offset := bitcask.offset
+	bitcask.mu.Unlock()
+	fileInfo, err = os.Stat(dataFilepath(dir, 1))
+	assert.Nil(t, err)
+	assert.EqualValues(t, fileInfo.Size(), offset)
+
+	bitcask.syncMu.Unlock()
+	wg.Wait()
+	bitcask.mu.Lock()
+	assert.Equal(t, bitcask.syncedOffset, bitcask.offset)
+	bitcask.mu.Unlock()
+}
+
+func TestClose(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithMaxFileSize(64), WithSyncPolicy(SyncInterval(time.Millisecond)))
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	for i := 0; i < 8; i++ {
+		key := strconv.Itoa(i)
+		err = bitcask.Put(ctx, []byte(key), []byte(key))
+		assert.Nil(t, err)
+		_, err = bitcask.Get(ctx, []byte(key))
+		assert.Nil(t, err)
+	}
+	assert.True(t, bitcask.rfiles.len() > 0)
+
+	err = bitcask.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, bitcask.rfiles.len(), 0)
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	_, err = bitcask.Get(ctx, []byte("0"))
+	assert.Equal(t, err, ErrClosed)
+	assert.Equal(t, bitcask.Put(ctx, []byte("0"), nil), ErrClosed)
+	assert.Equal(t, bitcask.Delete(ctx, []byte("0")), ErrClosed)
+	assert.Equal(t, bitcask.Sync(), ErrClosed)
+	assert.Equal(t, bitcask.Merge(ctx), ErrClosed)
+	_, err = bitcask.Keys(ctx)
+	assert.Equal(t, err, ErrClosed)
+	_, err = bitcask.Snapshot()
+	assert.Equal(t, err, ErrClosed)
+	it := bitcask.NewIterator(ctx)
+	assert.False(t, it.Next())
+	assert.Equal(t, it.Err(), ErrClosed)
+}
+
+func TestCloseConcurrent(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithSyncOnPut(true))
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	n := 8
+	written := make([][]string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				key := strconv.Itoa(i*1e6 + j)
+				err := bitcask.Put(ctx, []byte(key), []byte(key))
+				if err == ErrClosed {
+					return
+				}
+				assert.Nil(t, err)
+				written[i] = append(written[i], key)
+			}
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	err = bitcask.Close()
+	assert.Nil(t, err)
+	wg.Wait()
+
+	// open
+	bitcask, err = Open(dir)
+	assert.Nil(t, err)
+	defer bitcask.Close()
+	for _, keys := range written {
+		for _, key := range keys {
+			value, err := bitcask.Get(ctx, []byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, key, string(value))
+		}
+	}
+}
+
+func TestErrNotFound(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithErrNotFound(true))
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	ctx := context.Background()
+	_, err = bitcask.Get(ctx, []byte("key"))
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	err = bitcask.Put(ctx, []byte("key"), nil)
+	assert.Nil(t, err)
+	value, err := bitcask.Get(ctx, []byte("key"))
+	assert.Nil(t, err)
+	assert.NotNil(t, value)
+	assert.Len(t, value, 0)
+
+	err = bitcask.PutWithTTL(ctx, []byte("expired"), []byte("value"), -time.Second)
+	assert.Nil(t, err)
+	_, _, err = bitcask.GetWithVersion(ctx, []byte("expired"))
+	assert.Equal(t, err, ErrNotFound)
+
+	err = bitcask.Update(ctx, func(tx *Txn) error {
+		_, err := tx.Get([]byte("missing"))
+		assert.Equal(t, err, ErrNotFound)
+		err = tx.Delete([]byte("key"))
+		assert.Nil(t, err)
+		_, err = tx.Get([]byte("key"))
+		assert.Equal(t, err, ErrNotFound)
+		return nil
+	})
+	assert.Nil(t, err)
+	_, err = bitcask.Get(ctx, []byte("key"))
+	assert.Equal(t, err, ErrNotFound)
+
+	err = bitcask.Put(ctx, []byte("other"), []byte("value"))
+	assert.Nil(t, err)
+	it := bitcask.NewIterator(ctx)
+	err = bitcask.Delete(ctx, []byte("other"))
+	assert.Nil(t, err)
+	// both keys are gone by the time they are visited
+	assert.False(t, it.Next())
+	assert.Nil(t, it.Err())
+}
+
+func TestSizeLimits(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithMaxKeySize(4), WithMaxValueSize(8))
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	err = bitcask.Put(ctx, []byte("key"), []byte("value"))
+	assert.Nil(t, err)
+	err = bitcask.Put(ctx, []byte("large"), []byte("value"))
+	assert.Equal(t, err, ErrKeyTooLarge)
+	err = bitcask.Put(ctx, []byte("key"), []byte("large value"))
+	assert.Equal(t, err, ErrValueTooLarge)
+	err = bitcask.Delete(ctx, []byte("large"))
+	assert.Equal(t, err, ErrKeyTooLarge)
+	var batch Batch
+	batch.Put([]byte("key"), []byte("value"))
+	batch.Put([]byte("key"), []byte("large value"))
+	err = bitcask.Write(ctx, &batch)
+	assert.Equal(t, err, ErrValueTooLarge)
+	err = bitcask.Update(ctx, func(tx *Txn) error {
+		return tx.Put([]byte("key"), []byte("large value"))
+	})
+	assert.Equal(t, err, ErrValueTooLarge)
+	err = bitcask.Update(ctx, func(tx *Txn) error {
+		return tx.Delete([]byte("large"))
+	})
+	assert.Equal(t, err, ErrKeyTooLarge)
+	value, err := bitcask.Get(ctx, []byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(value))
+
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	bitcask, err = Open(dir)
+	assert.Nil(t, err)
+	err = bitcask.Put(ctx, []byte("key"), []byte("large value"))
+	assert.Nil(t, err)
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	// entries over the limits are corrupted when loading, even at the end
+	// of the last data file
+	_, err = Open(dir, WithMaxValueSize(8))
+	assert.True(t, errors.Is(err, ErrCorrupted))
+	assert.True(t, errors.Is(err, entry.ErrTooLarge))
+
+	bitcask, err = Open(dir, WithMaxValueSize(8), WithCorruptionPolicy(CorruptionTruncate))
+	assert.Nil(t, err)
+	defer bitcask.Close()
+	value, err = bitcask.Get(ctx, []byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(value))
+}
+
+func TestOpenHugeHeader(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithMaxFileSize(128))
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	for i := 0; i < 8; i++ {
+		key := strconv.Itoa(i)
+		err = bitcask.Put(ctx, []byte(key), []byte(key))
+		assert.Nil(t, err)
+	}
+	assert.True(t, bitcask.fileID > 1)
+	err = bitcask.Close()
+	assert.Nil(t, err)
+	err = os.Remove(hintFilepath(dir, 1))
+	assert.Nil(t, err)
+
+	// a value size far beyond the end of the file
+	file, err := os.OpenFile(dataFilepath(dir, 1), os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, 0x7fffffff)
+	_, err = file.WriteAt(b, entry.FileHeaderSize+12)
+	assert.Nil(t, err)
+	err = file.Close()
+	assert.Nil(t, err)
+
+	_, err = Open(dir)
+	assert.True(t, errors.Is(err, ErrCorrupted))
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+}
@@ -0,0 +1,159 @@
+package bitcask
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// CacheStats reports on the value cache of WithValueCache.
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+	// Size is the number of bytes of keys and values held, and Len the
+	// number of values.
+	Size int
+	Len  int
+}
+
+// valueCache holds recently read values up to maxSize bytes of keys and
+// values, evicting the least recently used ones. Each value is held along
+// with the item it was read from and only returned for that very item, so
+// a value read before a write to its key lands in the cache is never
+// served after it. A nil valueCache caches nothing.
+type valueCache struct {
+	// hits and misses come first to be 64-bit aligned for atomic access.
+	hits   uint64
+	misses uint64
+
+	maxSize      int
+	maxValueSize int
+
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type cacheEntry struct {
+	key   string
+	item  *item
+	value []byte
+}
+
+func newValueCache(maxSize, maxValueSize int) *valueCache {
+	if maxSize <= 0 {
+		return nil
+	}
+	return &valueCache{
+		maxSize:      maxSize,
+		maxValueSize: maxValueSize,
+		entries:      make(map[string]*list.Element),
+		lru:          list.New(),
+	}
+}
+
+// get returns a copy of the value read from item for key.
+func (cache *valueCache) get(key []byte, item *item) ([]byte, bool) {
+	if cache == nil {
+		return nil, false
+	}
+	cache.mu.Lock()
+	elem, ok := cache.entries[string(key)]
+	if !ok || elem.Value.(*cacheEntry).item != item {
+		cache.mu.Unlock()
+		atomic.AddUint64(&cache.misses, 1)
+		return nil, false
+	}
+	cache.lru.MoveToFront(elem)
+	value := copyValue(elem.Value.(*cacheEntry).value)
+	cache.mu.Unlock()
+	atomic.AddUint64(&cache.hits, 1)
+	return value, true
+}
+
+// put caches a copy of value, read from item for key, unless it is over
+// the size threshold.
+func (cache *valueCache) put(key []byte, item *item, value []byte) {
+	if cache == nil {
+		return
+	}
+	size := len(key) + len(value)
+	if size > cache.maxSize || (cache.maxValueSize > 0 && len(value) > cache.maxValueSize) {
+		return
+	}
+	e := &cacheEntry{
+		key:   string(key),
+		item:  item,
+		value: copyValue(value),
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if elem, ok := cache.entries[e.key]; ok {
+		cache.removeLocked(elem)
+	}
+	cache.entries[e.key] = cache.lru.PushFront(e)
+	cache.size += size
+	for cache.size > cache.maxSize {
+		cache.removeLocked(cache.lru.Back())
+	}
+}
+
+// remove drops the value of key.
+func (cache *valueCache) remove(key string) {
+	if cache == nil {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if elem, ok := cache.entries[key]; ok {
+		cache.removeLocked(elem)
+	}
+}
+
+// replace points the value of key read from old at new, when a merge has
+// copied it there.
+func (cache *valueCache) replace(key string, old, new *item) {
+	if cache == nil {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if elem, ok := cache.entries[key]; ok && elem.Value.(*cacheEntry).item == old {
+		elem.Value.(*cacheEntry).item = new
+	}
+}
+
+func (cache *valueCache) removeLocked(elem *list.Element) {
+	e := cache.lru.Remove(elem).(*cacheEntry)
+	delete(cache.entries, e.key)
+	cache.size -= len(e.key) + len(e.value)
+}
+
+// copyValue copies value, keeping an empty value apart from a missing one.
+func copyValue(value []byte) []byte {
+	v := make([]byte, len(value))
+	copy(v, value)
+	return v
+}
+
+func (cache *valueCache) stats() CacheStats {
+	if cache == nil {
+		return CacheStats{}
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&cache.hits),
+		Misses: atomic.LoadUint64(&cache.misses),
+		Size:   cache.size,
+		Len:    cache.lru.Len(),
+	}
+}
+
+// CacheStats returns the counters of the value cache, all zero if there is
+// none.
+func (bitcask *Bitcask) CacheStats() CacheStats {
+	return bitcask.cache.stats()
+}
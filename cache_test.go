@@ -0,0 +1,123 @@
+package bitcask
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValueCache(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithValueCache(1024), WithValueCacheThreshold(64))
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	ctx := context.Background()
+	key := []byte("key")
+	err = bitcask.Put(ctx, key, []byte("value"))
+	assert.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		value, err := bitcask.Get(ctx, key)
+		assert.Nil(t, err)
+		assert.Equal(t, "value", string(value))
+		// values are copied out of the cache
+		value[0] = 'x'
+	}
+	stats := bitcask.CacheStats()
+	assert.EqualValues(t, stats.Hits, 1)
+	assert.EqualValues(t, stats.Misses, 1)
+	assert.Equal(t, stats.Len, 1)
+	assert.Equal(t, stats.Size, len("key")+len("value"))
+
+	// writes drop the cached value
+	err = bitcask.Put(ctx, key, []byte("new"))
+	assert.Nil(t, err)
+	assert.Equal(t, bitcask.CacheStats().Len, 0)
+	value, err := bitcask.Get(ctx, key)
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(value))
+	err = bitcask.Delete(ctx, key)
+	assert.Nil(t, err)
+	value, err = bitcask.Get(ctx, key)
+	assert.Nil(t, err)
+	assert.Nil(t, value)
+
+	// over the threshold
+	large := bytes.Repeat([]byte("v"), 65)
+	err = bitcask.Put(ctx, []byte("large"), large)
+	assert.Nil(t, err)
+	value, err = bitcask.Get(ctx, []byte("large"))
+	assert.Nil(t, err)
+	assert.Equal(t, large, value)
+	assert.Equal(t, bitcask.CacheStats().Len, 0)
+
+	// bounded in bytes
+	n := 256
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		err = bitcask.Put(ctx, []byte(key), bytes.Repeat([]byte(key), 8))
+		assert.Nil(t, err)
+		_, err = bitcask.Get(ctx, []byte(key))
+		assert.Nil(t, err)
+	}
+	stats = bitcask.CacheStats()
+	assert.True(t, stats.Size <= 1024)
+	assert.True(t, stats.Len < n)
+
+	// merged values stay cached
+	hits := stats.Hits
+	err = bitcask.Merge(ctx)
+	assert.Nil(t, err)
+	key = []byte(strconv.Itoa(n - 1))
+	value, err = bitcask.Get(ctx, key)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat(key, 8), value)
+	assert.Equal(t, bitcask.CacheStats().Hits, hits+1)
+}
+
+func TestValueCacheEmptyValue(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithValueCache(1024))
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	ctx := context.Background()
+	err = bitcask.Put(ctx, []byte("empty"), []byte{})
+	assert.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		value, err := bitcask.Get(ctx, []byte("empty"))
+		assert.Nil(t, err)
+		assert.NotNil(t, value)
+		assert.Empty(t, value)
+	}
+	assert.EqualValues(t, bitcask.CacheStats().Hits, 1)
+}
+
+func TestValueCacheStale(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithValueCache(1024))
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	ctx := context.Background()
+	key := []byte("key")
+	err = bitcask.Put(ctx, key, []byte("old"))
+	assert.Nil(t, err)
+	old, ok := bitcask.keydir.Get(string(key))
+	assert.True(t, ok)
+	err = bitcask.Put(ctx, key, []byte("new"))
+	assert.Nil(t, err)
+
+	// a value read before the put lands in the cache after it
+	bitcask.cache.put(key, old, []byte("old"))
+	value, err := bitcask.Get(ctx, key)
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(value))
+}
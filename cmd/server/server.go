@@ -25,7 +25,7 @@ type server struct {
 }
 
 func newServer(dir string, addr string) (*server, error) {
-	bitcask, err := bitcask.Open(dir)
+	bitcask, err := bitcask.Open(dir, bitcask.WithErrNotFound(true))
 	if err != nil {
 		return nil, err
 	}
@@ -93,14 +93,14 @@ func (s *server) get(ctx context.Context, conn redcon.Conn, cmd redcon.Command)
 	}
 	key := cmd.Args[1]
 	value, err := s.bitcask.Get(ctx, key)
+	if errors.Is(err, bitcask.ErrNotFound) {
+		conn.WriteNull()
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	if value != nil {
-		conn.WriteBulk(value)
-	} else {
-		conn.WriteNull()
-	}
+	conn.WriteBulk(value)
 	return nil
 }
 
@@ -0,0 +1,160 @@
+package bitcask
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/decimalbell/bitcask/entry"
+)
+
+// Codec compresses values. Its ID is recorded in the header of every entry
+// whose value it compressed, so a store must be opened with the codec for
+// as long as such entries remain. IDs 1 to 15 are reserved for the codecs
+// of this package, zero stands for no compression.
+type Codec interface {
+	ID() uint8
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+var (
+	// Flate compresses values with DEFLATE.
+	Flate Codec = flateCodec{}
+	// Gzip compresses values with gzip.
+	Gzip Codec = gzipCodec{}
+	// Zlib compresses values with zlib.
+	Zlib Codec = zlibCodec{}
+)
+
+var codecs = map[uint8]Codec{
+	Flate.ID(): Flate,
+	Gzip.ID():  Gzip,
+	Zlib.ID():  Zlib,
+}
+
+// maxReservedCodecID is the highest codec ID reserved for this package.
+const maxReservedCodecID = 15
+
+// checkCodec returns ErrCodec if codec has ID zero, which would store its
+// output as uncompressed values, or a reserved ID that is not its own,
+// which would take over decoding the values of a built-in codec.
+func checkCodec(codec Codec) error {
+	if codec == nil {
+		return nil
+	}
+	id := codec.ID()
+	if id == 0 || (id <= maxReservedCodecID && codecs[id] != codec) {
+		return ErrCodec
+	}
+	return nil
+}
+
+type flateCodec struct{}
+
+func (flateCodec) ID() uint8 {
+	return 1
+}
+
+func (flateCodec) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	return compress(&buf, w, src)
+}
+
+func (flateCodec) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) ID() uint8 {
+	return 2
+}
+
+func (gzipCodec) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	return compress(&buf, gzip.NewWriter(&buf), src)
+}
+
+func (gzipCodec) Decompress(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+type zlibCodec struct{}
+
+func (zlibCodec) ID() uint8 {
+	return 3
+}
+
+func (zlibCodec) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	return compress(&buf, zlib.NewWriter(&buf), src)
+}
+
+func (zlibCodec) Decompress(src []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func compress(buf *bytes.Buffer, w io.WriteCloser, src []byte) ([]byte, error) {
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// compressValue returns the value to store for value along with the flags
+// marking its codec. Values no longer than the compression threshold, and
+// values compression does not make smaller, are stored as is.
+func (bitcask *Bitcask) compressValue(value []byte) ([]byte, uint32, error) {
+	codec := bitcask.options.codec
+	if codec == nil || len(value) <= bitcask.options.compressionThreshold {
+		return value, 0, nil
+	}
+	compressed, err := codec.Compress(value)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(compressed) >= len(value) {
+		return value, 0, nil
+	}
+	return compressed, entry.CodecFlags(codec.ID()), nil
+}
+
+// decompressValue returns the value stored in e.
+func (bitcask *Bitcask) decompressValue(e *entry.Entry) ([]byte, error) {
+	id := e.Codec()
+	if id == 0 {
+		return e.Value, nil
+	}
+	codec, ok := codecs[id]
+	if c := bitcask.options.codec; !ok && c != nil && c.ID() == id {
+		codec, ok = c, true
+	}
+	if !ok {
+		return nil, fmt.Errorf("bitcask: unknown codec %d", id)
+	}
+	return codec.Decompress(e.Value)
+}
@@ -0,0 +1,134 @@
+package bitcask
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodec(t *testing.T) {
+	value := bytes.Repeat([]byte("bitcask"), 64)
+	for _, codec := range []Codec{Flate, Gzip, Zlib} {
+		compressed, err := codec.Compress(value)
+		assert.Nil(t, err)
+		assert.True(t, len(compressed) < len(value))
+
+		decompressed, err := codec.Decompress(compressed)
+		assert.Nil(t, err)
+		assert.Equal(t, value, decompressed)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	for _, codec := range []Codec{Flate, Gzip, Zlib} {
+		testCompression(t, codec)
+	}
+}
+
+func testCompression(t *testing.T, codec Codec) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithMaxFileSize(4096), WithCompression(codec))
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	n := 64
+	values := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		// large values are compressed, small ones are not
+		values[i] = []byte(key)
+		if i%2 == 0 {
+			values[i] = bytes.Repeat([]byte(key), 256)
+		}
+		err = bitcask.Put(ctx, []byte(key), values[i])
+		assert.Nil(t, err)
+	}
+	var batch Batch
+	batch.Put([]byte("batch"), bytes.Repeat([]byte("batch"), 256))
+	err = bitcask.Write(ctx, &batch)
+	assert.Nil(t, err)
+	assert.True(t, dirSize(t, dir) < int64(n*256))
+
+	for i := 0; i < n; i++ {
+		value, err := bitcask.Get(ctx, []byte(strconv.Itoa(i)))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], value)
+	}
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	// without compression, mixing compressed and uncompressed values
+	bitcask, err = Open(dir, WithMaxFileSize(4096))
+	assert.Nil(t, err)
+	for i := 0; i < n; i += 4 {
+		key := strconv.Itoa(i)
+		values[i] = bytes.Repeat([]byte(key+"new"), 256)
+		err = bitcask.Put(ctx, []byte(key), values[i])
+		assert.Nil(t, err)
+	}
+	err = bitcask.Merge(ctx)
+	assert.Nil(t, err)
+	for i := 0; i < n; i++ {
+		value, err := bitcask.Get(ctx, []byte(strconv.Itoa(i)))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], value)
+	}
+	value, err := bitcask.Get(ctx, []byte("batch"))
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("batch"), 256), value)
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	// open
+	bitcask, err = Open(dir, WithCompression(codec))
+	assert.Nil(t, err)
+	defer bitcask.Close()
+	assert.Equal(t, bitcask.Len(), n+1)
+	for i := 0; i < n; i++ {
+		value, err := bitcask.Get(ctx, []byte(strconv.Itoa(i)))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], value)
+	}
+}
+
+type testCodec struct {
+	id uint8
+}
+
+func (codec testCodec) ID() uint8 {
+	return codec.id
+}
+
+func (codec testCodec) Compress(src []byte) ([]byte, error) {
+	return Flate.Compress(src)
+}
+
+func (codec testCodec) Decompress(src []byte) ([]byte, error) {
+	return Flate.Decompress(src)
+}
+
+func TestCompressionCodecID(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	for _, id := range []uint8{0, Flate.ID(), maxReservedCodecID} {
+		_, err := Open(dir, WithCompression(testCodec{id: id}))
+		assert.Equal(t, err, ErrCodec)
+	}
+
+	bitcask, err := Open(dir, WithCompression(testCodec{id: maxReservedCodecID + 1}))
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	ctx := context.Background()
+	value := bytes.Repeat([]byte("value"), 200)
+	err = bitcask.Put(ctx, []byte("key"), value)
+	assert.Nil(t, err)
+	v, err := bitcask.Get(ctx, []byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, value, v)
+}
@@ -0,0 +1,222 @@
+package bitcask
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/decimalbell/bitcask/entry"
+)
+
+// KeyProvider supplies the AES keys of WithEncryption, 16, 24 or 32 bytes
+// long. Each key has a nonzero ID that is recorded with every entry it
+// encrypts, and must always stand for the same key.
+type KeyProvider interface {
+	// CurrentKey returns the key to encrypt new entries with. It is
+	// called for every write, so rotating keys only takes changing what
+	// it returns.
+	CurrentKey() (id uint16, key []byte, err error)
+	// Key returns the key of the given ID. Keys must stay available for
+	// as long as entries encrypted with them remain, which a merge ends by
+	// encrypting everything it rewrites with the current key.
+	Key(id uint16) ([]byte, error)
+}
+
+type staticKeys struct {
+	current uint16
+	keys    map[uint16][]byte
+}
+
+// StaticKeys returns a KeyProvider holding a fixed set of keys, which
+// encrypts with the key of ID current.
+func StaticKeys(current uint16, keys map[uint16][]byte) KeyProvider {
+	return &staticKeys{current: current, keys: keys}
+}
+
+func (p *staticKeys) CurrentKey() (uint16, []byte, error) {
+	key, err := p.Key(p.current)
+	return p.current, key, err
+}
+
+func (p *staticKeys) Key(id uint16) ([]byte, error) {
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("bitcask: unknown key %d", id)
+	}
+	return key, nil
+}
+
+var (
+	errInvalidKeyID = errors.New("bitcask: invalid key id 0")
+	errShortSealed  = errors.New("bitcask: sealed data too short")
+)
+
+// Parts of an entry, told apart in the associated data so that one cannot
+// pass for the other.
+const (
+	partKey   = 0
+	partValue = 1
+)
+
+// crypter encrypts the keys and values of entries with AES-GCM. Each is
+// sealed with a random nonce, which is stored in front of it, and the file
+// ID and offset of its entry as associated data, so an entry cannot be
+// moved around unnoticed. A nil crypter stores everything in the clear.
+type crypter struct {
+	provider KeyProvider
+
+	mu    sync.Mutex
+	aeads map[uint16]cipher.AEAD
+}
+
+func newCrypter(provider KeyProvider) *crypter {
+	return &crypter{
+		provider: provider,
+		aeads:    make(map[uint16]cipher.AEAD),
+	}
+}
+
+// overhead returns how many bytes sealing adds to a key or a value.
+func (c *crypter) overhead() int {
+	if c == nil {
+		return 0
+	}
+	return 12 + 16
+}
+
+func (c *crypter) aead(id uint16, key []byte) (cipher.AEAD, error) {
+	if id == 0 {
+		return nil, errInvalidKeyID
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if aead, ok := c.aeads[id]; ok {
+		return aead, nil
+	}
+	if key == nil {
+		var err error
+		if key, err = c.provider.Key(id); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	c.aeads[id] = aead
+	return aead, nil
+}
+
+// seal encrypts the key and value of an entry written at offset in the
+// data file fileID with the current key, and returns the ID of the key.
+func (c *crypter) seal(fileID uint32, offset uint64, key, value []byte) (uint16, []byte, []byte, error) {
+	if c == nil {
+		return 0, key, value, nil
+	}
+	id, k, err := c.provider.CurrentKey()
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	aead, err := c.aead(id, k)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	skey, err := sealPart(aead, fileID, offset, partKey, key)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	svalue, err := sealPart(aead, fileID, offset, partValue, value)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return id, skey, svalue, nil
+}
+
+// sealKey encrypts the key of an entry at offset in the data file fileID
+// with the key of the given ID, for a hint file.
+func (c *crypter) sealKey(id uint16, fileID uint32, offset uint64, key []byte) ([]byte, error) {
+	if id == 0 {
+		return key, nil
+	}
+	if c == nil {
+		return nil, ErrEncrypted
+	}
+	aead, err := c.aead(id, nil)
+	if err != nil {
+		return nil, err
+	}
+	return sealPart(aead, fileID, offset, partKey, key)
+}
+
+// open decrypts the key and value of e, an entry at offset in the data
+// file fileID, in place. Entries stored in the clear are left alone.
+func (c *crypter) open(e *entry.Entry, fileID uint32, offset uint64) error {
+	id := e.KeyID()
+	if id == 0 {
+		return nil
+	}
+	key, err := c.openKey(id, fileID, offset, e.Key)
+	if err != nil {
+		return err
+	}
+	aead, err := c.aead(id, nil)
+	if err != nil {
+		return err
+	}
+	value, err := openPart(aead, fileID, offset, partValue, e.Value)
+	if err != nil {
+		return err
+	}
+	e.Key, e.Value = key, value
+	return nil
+}
+
+// openKey decrypts a key sealed by seal or sealKey.
+func (c *crypter) openKey(id uint16, fileID uint32, offset uint64, key []byte) ([]byte, error) {
+	if id == 0 {
+		return key, nil
+	}
+	if c == nil {
+		return nil, ErrEncrypted
+	}
+	aead, err := c.aead(id, nil)
+	if err != nil {
+		return nil, err
+	}
+	return openPart(aead, fileID, offset, partKey, key)
+}
+
+func sealPart(aead cipher.AEAD, fileID uint32, offset uint64, part byte, plaintext []byte) ([]byte, error) {
+	buf := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	return aead.Seal(buf, buf, plaintext, additionalData(fileID, offset, part)), nil
+}
+
+func openPart(aead cipher.AEAD, fileID uint32, offset uint64, part byte, ciphertext []byte) ([]byte, error) {
+	n := aead.NonceSize()
+	if len(ciphertext) < n+aead.Overhead() {
+		return nil, errShortSealed
+	}
+	// Opening into a non-nil buffer keeps an empty value apart from a
+	// missing one.
+	buf := make([]byte, 0, len(ciphertext)-n-aead.Overhead())
+	return aead.Open(buf, ciphertext[:n], ciphertext[n:], additionalData(fileID, offset, part))
+}
+
+func additionalData(fileID uint32, offset uint64, part byte) []byte {
+	buf := make([]byte, 13)
+	binary.LittleEndian.PutUint32(buf[0:], fileID)
+	binary.LittleEndian.PutUint64(buf[4:], offset)
+	buf[12] = part
+	return buf
+}
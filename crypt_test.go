@@ -0,0 +1,132 @@
+package bitcask
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// dirContains reports whether any file in dir contains b.
+func dirContains(t *testing.T, dir string, b []byte) bool {
+	names, err := readDirnames(dir)
+	assert.Nil(t, err)
+	for _, name := range names {
+		buf, err := ioutil.ReadFile(filepath.Join(dir, name))
+		assert.Nil(t, err)
+		if bytes.Contains(buf, b) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestEncryption(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	key1 := bytes.Repeat([]byte{1}, 32)
+	key2 := bytes.Repeat([]byte{2}, 16)
+	bitcask, err := Open(dir, WithMaxFileSize(1024), WithEncryption(StaticKeys(1, map[uint16][]byte{1: key1})))
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	n := 128
+	for i := 0; i < n; i++ {
+		key := "secret-key-" + strconv.Itoa(i)
+		err = bitcask.Put(ctx, []byte(key), []byte("secret-value-"+strconv.Itoa(i)))
+		assert.Nil(t, err)
+	}
+	var batch Batch
+	batch.Put([]byte("secret-batch"), []byte("secret-value-batch"))
+	batch.Delete([]byte("secret-key-0"))
+	err = bitcask.Write(ctx, &batch)
+	assert.Nil(t, err)
+	err = bitcask.Close()
+	assert.Nil(t, err)
+	assert.False(t, dirContains(t, dir, []byte("secret")))
+
+	// without the keys
+	_, err = Open(dir)
+	assert.True(t, errors.Is(err, ErrEncrypted))
+
+	// rotate to a new key
+	keys := map[uint16][]byte{1: key1, 2: key2}
+	bitcask, err = Open(dir, WithMaxFileSize(1024), WithEncryption(StaticKeys(2, keys)))
+	assert.Nil(t, err)
+	assert.Equal(t, bitcask.Len(), n)
+	for i := 2; i < n; i += 2 {
+		key := "secret-key-" + strconv.Itoa(i)
+		err = bitcask.Put(ctx, []byte(key), []byte("secret-new-"+strconv.Itoa(i)))
+		assert.Nil(t, err)
+	}
+	err = bitcask.Merge(ctx)
+	assert.Nil(t, err)
+	err = bitcask.Close()
+	assert.Nil(t, err)
+	assert.False(t, dirContains(t, dir, []byte("secret")))
+
+	// the old key is gone after the merge
+	bitcask, err = Open(dir, WithEncryption(StaticKeys(2, map[uint16][]byte{2: key2})))
+	assert.Nil(t, err)
+	defer bitcask.Close()
+	assert.Equal(t, bitcask.Len(), n)
+	for i := 1; i < n; i++ {
+		key := "secret-key-" + strconv.Itoa(i)
+		value, err := bitcask.Get(ctx, []byte(key))
+		assert.Nil(t, err)
+		if i%2 == 0 {
+			assert.Equal(t, "secret-new-"+strconv.Itoa(i), string(value))
+		} else {
+			assert.Equal(t, "secret-value-"+strconv.Itoa(i), string(value))
+		}
+	}
+	value, err := bitcask.Get(ctx, []byte("secret-batch"))
+	assert.Nil(t, err)
+	assert.Equal(t, "secret-value-batch", string(value))
+	value, err = bitcask.Get(ctx, []byte("secret-key-0"))
+	assert.Nil(t, err)
+	assert.Nil(t, value)
+}
+
+func TestEncryptionWrongKey(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithEncryption(StaticKeys(1, map[uint16][]byte{1: bytes.Repeat([]byte{1}, 32)})))
+	assert.Nil(t, err)
+	err = bitcask.Put(context.Background(), []byte("key"), []byte("value"))
+	assert.Nil(t, err)
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	_, err = Open(dir, WithEncryption(StaticKeys(1, map[uint16][]byte{1: bytes.Repeat([]byte{2}, 32)})))
+	assert.True(t, errors.Is(err, ErrCorrupted))
+}
+
+func TestEncryptionEmptyValue(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithErrNotFound(true), WithEncryption(StaticKeys(1, map[uint16][]byte{1: bytes.Repeat([]byte{1}, 32)})))
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	ctx := context.Background()
+	err = bitcask.Put(ctx, []byte("empty"), []byte{})
+	assert.Nil(t, err)
+	value, err := bitcask.Get(ctx, []byte("empty"))
+	assert.Nil(t, err)
+	assert.NotNil(t, value)
+	assert.Empty(t, value)
+
+	// the stored size counts the nonce and tag
+	err = bitcask.ForEach(ctx, func(key []byte, meta ItemMeta) error {
+		assert.EqualValues(t, meta.ValueSize, 28)
+		return nil
+	})
+	assert.Nil(t, err)
+}
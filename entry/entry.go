@@ -3,87 +3,394 @@ package entry
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"hash/crc32"
 	"io"
 )
 
+// Data files written since Version2 start with a file header holding Magic
+// and the format version. Files without one are Version1 files, whose
+// entries have a 16 byte header without flags. Version2 entries add flags
+// and Version3 entries an expiry time. Version4 entries add a sequence
+// number; entries of earlier versions all have sequence number 1.
+// Version5 entries have the same layout and may have compressed values,
+// marked by FlagCodec, and Version6 entries may have encrypted keys and
+// values, marked by FlagKeyID.
+const (
+	Magic   = 0x6b736362 // "bcsk"
+	Version = Version6
+
+	Version1 = 1
+	Version2 = 2
+	Version3 = 3
+	Version4 = 4
+	Version5 = 5
+	Version6 = 6
+
+	FileHeaderSize = 8
+	HeaderSizeV1   = 16
+	HeaderSizeV2   = 20
+	HeaderSizeV3   = 24
+	HeaderSize     = 32
+)
+
+const (
+	// FlagTombstone marks the entry of a deleted key.
+	FlagTombstone uint32 = 1 << iota
+	// FlagBatch marks an entry written as part of a batch. It only takes
+	// effect once the commit record of the batch follows it.
+	FlagBatch
+	// FlagCommit marks the commit record that ends a batch. Its value holds
+	// the number of entries in the batch.
+	FlagCommit
+)
+
+const (
+	// FlagCodec holds the ID of the codec the value is compressed with,
+	// zero for a value stored as is.
+	FlagCodec uint32 = 0xff << 8
+	// FlagKeyID holds the ID of the key the key and value are encrypted
+	// with, zero for an entry stored in the clear.
+	FlagKeyID uint32 = 0xffff << 16
+)
+
+var (
+	ErrInvalidCRC     = errors.New("entry: invalid crc")
+	ErrInvalidVersion = errors.New("entry: invalid version")
+	ErrTooLarge       = errors.New("entry: key or value too large")
+)
+
 type Entry struct {
 	CRC       uint32
 	Timestamp uint32
 	KeySize   uint32
 	ValueSize uint32
-	Key       []byte
-	Value     []byte
+	Flags     uint32
+	// Expiry is the Unix time in seconds the entry expires at, or zero if
+	// it never does.
+	Expiry uint32
+	// Seq is the sequence number of the write, which increases with every
+	// write to a store.
+	Seq   uint64
+	Key   []byte
+	Value []byte
+
+	headerSize int
 }
 
+// Size returns the size of the entry as stored, which holds even once its
+// key and value have been replaced by their decrypted forms.
 func (e *Entry) Size() int {
-	return 16 + len(e.Key) + len(e.Value)
+	return e.headerSize + int(e.KeySize) + int(e.ValueSize)
 }
 
 func (e *Entry) IsDeleted() bool {
-	return e.ValueSize == 0
+	return e.Flags&FlagTombstone != 0
+}
+
+func (e *Entry) InBatch() bool {
+	return e.Flags&FlagBatch != 0
+}
+
+func (e *Entry) IsCommit() bool {
+	return e.Flags&FlagCommit != 0
+}
+
+// Codec returns the ID of the codec the value is compressed with, or zero
+// if it is not compressed.
+func (e *Entry) Codec() uint8 {
+	return uint8((e.Flags & FlagCodec) >> 8)
+}
+
+// CodecFlags returns the flags marking a value compressed with the codec
+// of the given ID.
+func CodecFlags(id uint8) uint32 {
+	return uint32(id) << 8
+}
+
+// KeyID returns the ID of the key the key and value are encrypted with, or
+// zero if they are not encrypted.
+func (e *Entry) KeyID() uint16 {
+	return uint16((e.Flags & FlagKeyID) >> 16)
+}
+
+// KeyIDFlags returns the flags marking an entry encrypted with the key of
+// the given ID.
+func KeyIDFlags(id uint16) uint32 {
+	return uint32(id) << 16
+}
+
+// IsExpired reports whether the entry has expired at now, a Unix time in
+// seconds.
+func (e *Entry) IsExpired(now uint32) bool {
+	return e.Expiry != 0 && e.Expiry <= now
 }
 
 func EncodedLen(key, value []byte) int {
-	return 16 + len(key) + len(value)
+	return HeaderSize + len(key) + len(value)
 }
 
-func Encode(key, value []byte, ts uint32) []byte {
-	size := 16 + len(key) + len(value)
+// EncodeFileHeader returns the header every data file starts with.
+func EncodeFileHeader() []byte {
+	buf := make([]byte, FileHeaderSize)
+	binary.LittleEndian.PutUint32(buf[0:], Magic)
+	binary.LittleEndian.PutUint32(buf[4:], Version)
+	return buf
+}
+
+// FileVersion returns the format version of a data file given its first
+// FileHeaderSize bytes, or fewer if the file is shorter than that. An empty
+// file gets its header on the first append, so it has the current version.
+func FileVersion(header []byte) (int, error) {
+	if len(header) == 0 {
+		return Version, nil
+	}
+	if len(header) < FileHeaderSize || binary.LittleEndian.Uint32(header[0:4]) != Magic {
+		return Version1, nil
+	}
+	version := int(binary.LittleEndian.Uint32(header[4:8]))
+	if version < Version2 || version > Version6 {
+		return 0, ErrInvalidVersion
+	}
+	return version, nil
+}
+
+func headerSize(version int) int {
+	switch version {
+	case Version1:
+		return HeaderSizeV1
+	case Version2:
+		return HeaderSizeV2
+	case Version3:
+		return HeaderSizeV3
+	default:
+		return HeaderSize
+	}
+}
+
+func Encode(key, value []byte, ts, expiry uint32, seq uint64, flags uint32) []byte {
+	size := HeaderSize + len(key) + len(value)
 	buf := make([]byte, size)
 	binary.LittleEndian.PutUint32(buf[4:], uint32(ts))
 	binary.LittleEndian.PutUint32(buf[8:], uint32(len(key)))
 	binary.LittleEndian.PutUint32(buf[12:], uint32(len(value)))
-	copy(buf[16:], key)
-	copy(buf[16+len(key):], value)
+	binary.LittleEndian.PutUint32(buf[16:], flags)
+	binary.LittleEndian.PutUint32(buf[20:], expiry)
+	binary.LittleEndian.PutUint64(buf[24:], seq)
+	copy(buf[HeaderSize:], key)
+	copy(buf[HeaderSize+len(key):], value)
 	crc := crc32.ChecksumIEEE(buf[4:])
 	binary.LittleEndian.PutUint32(buf, crc)
 	return buf
 }
 
+// decodeHeader decodes an entry header of the given version.
+func decodeHeader(buf []byte, version int) *Entry {
+	e := &Entry{
+		CRC:        binary.LittleEndian.Uint32(buf[0:4]),
+		Timestamp:  binary.LittleEndian.Uint32(buf[4:8]),
+		KeySize:    binary.LittleEndian.Uint32(buf[8:12]),
+		ValueSize:  binary.LittleEndian.Uint32(buf[12:16]),
+		headerSize: headerSize(version),
+	}
+	if version == Version1 {
+		// Version1 has no flags, an empty value marks a deleted key.
+		if e.ValueSize == 0 {
+			e.Flags = FlagTombstone
+		}
+	} else {
+		e.Flags = binary.LittleEndian.Uint32(buf[16:20])
+	}
+	if version >= Version3 {
+		e.Expiry = binary.LittleEndian.Uint32(buf[20:24])
+	}
+	if version >= Version4 {
+		e.Seq = binary.LittleEndian.Uint64(buf[24:32])
+	} else {
+		e.Seq = 1
+	}
+	return e
+}
+
+// Decode decodes the entry of the given version at the start of buf and
+// verifies its CRC. On a CRC mismatch the decoded entry is returned along
+// with ErrInvalidCRC.
+func Decode(buf []byte, version int) (*Entry, error) {
+	hsize := headerSize(version)
+	if len(buf) < hsize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	e := decodeHeader(buf, version)
+
+	size := uint64(hsize) + uint64(e.KeySize) + uint64(e.ValueSize)
+	if uint64(len(buf)) < size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	e.Key = buf[hsize : uint64(hsize)+uint64(e.KeySize)]
+	e.Value = buf[uint64(hsize)+uint64(e.KeySize) : size]
+	if crc32.ChecksumIEEE(buf[4:size]) != e.CRC {
+		return e, ErrInvalidCRC
+	}
+	return e, nil
+}
+
 type Reader struct {
-	r *bufio.Reader
+	r       *bufio.Reader
+	version int
+
+	maxKeySize   uint32
+	maxValueSize uint32
+	// remaining is the number of bytes left to read, or -1 if unknown.
+	remaining int64
 }
 
 func NewReader(r io.Reader) *Reader {
 	return &Reader{
-		r: bufio.NewReader(r),
+		r:         bufio.NewReader(r),
+		remaining: -1,
 	}
 }
 
 func NewReaderSize(r io.Reader, size int) *Reader {
 	return &Reader{
-		r: bufio.NewReaderSize(r, size),
+		r:         bufio.NewReaderSize(r, size),
+		remaining: -1,
 	}
 }
 
+// SetLimits bounds the entries Read accepts, which it checks from the
+// header before allocating anything. An entry with a key longer than
+// maxKeySize or a value longer than maxValueSize is reported as
+// ErrTooLarge, and one running past size bytes from the start of the file
+// as io.ErrUnexpectedEOF. A size below zero or a maximum of zero sets no
+// bound.
+func (r *Reader) SetLimits(size int64, maxKeySize, maxValueSize uint32) {
+	r.remaining = size
+	r.maxKeySize = maxKeySize
+	r.maxValueSize = maxValueSize
+}
+
+// consume accounts for n bytes read.
+func (r *Reader) consume(n int64) {
+	if r.remaining >= 0 {
+		r.remaining -= n
+	}
+}
+
+// ReadFileHeader reads the file header, if there is one, and returns the
+// number of bytes it takes. It is called by the first Read if need be.
+func (r *Reader) ReadFileHeader() (int, error) {
+	if r.version != 0 {
+		return 0, nil
+	}
+	header, err := r.r.Peek(FileHeaderSize)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	version, err := FileVersion(header)
+	if err != nil {
+		return 0, err
+	}
+	r.version = version
+	if version == Version1 || len(header) == 0 {
+		return 0, nil
+	}
+	n, err := r.r.Discard(FileHeaderSize)
+	r.consume(int64(n))
+	return n, err
+}
+
+// Version returns the format version of the file being read.
+func (r *Reader) Version() int {
+	return r.version
+}
+
+// Read reads the next entry and verifies its CRC. On a CRC mismatch the
+// entry is returned along with ErrInvalidCRC, so the caller can skip it.
 func (r *Reader) Read() (*Entry, error) {
-	buf := make([]byte, 16)
-	if _, err := io.ReadFull(r.r, buf); err != nil {
+	if _, err := r.ReadFileHeader(); err != nil {
 		return nil, err
 	}
 
-	crc := binary.LittleEndian.Uint32(buf[0:4])
-	timestamp := binary.LittleEndian.Uint32(buf[4:8])
-	keySize := binary.LittleEndian.Uint32(buf[8:12])
-	valueSize := binary.LittleEndian.Uint32(buf[12:16])
+	buf := make([]byte, headerSize(r.version))
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return nil, err
+	}
+	r.consume(int64(len(buf)))
+	e := decodeHeader(buf, r.version)
+	if (r.maxKeySize > 0 && e.KeySize > r.maxKeySize) || (r.maxValueSize > 0 && e.ValueSize > r.maxValueSize) {
+		return nil, ErrTooLarge
+	}
+	size := int64(e.KeySize) + int64(e.ValueSize)
+	if r.remaining >= 0 && size > r.remaining {
+		return nil, io.ErrUnexpectedEOF
+	}
 
-	key := make([]byte, keySize)
+	key := make([]byte, e.KeySize)
 	if _, err := io.ReadFull(r.r, key); err != nil {
-		return nil, err
+		return nil, unexpectedEOF(err)
 	}
 
-	value := make([]byte, valueSize)
+	value := make([]byte, e.ValueSize)
 	if _, err := io.ReadFull(r.r, value); err != nil {
-		return nil, err
+		return nil, unexpectedEOF(err)
 	}
 
-	return &Entry{
-		CRC:       crc,
-		Timestamp: timestamp,
-		KeySize:   keySize,
-		ValueSize: valueSize,
-		Key:       key,
-		Value:     value,
-	}, nil
+	r.consume(size)
+
+	e.Key = key
+	e.Value = value
+	h := crc32.ChecksumIEEE(buf[4:])
+	h = crc32.Update(h, crc32.IEEETable, key)
+	h = crc32.Update(h, crc32.IEEETable, value)
+	if h != e.CRC {
+		return e, ErrInvalidCRC
+	}
+	return e, nil
+}
+
+// unexpectedEOF reports io.EOF after a header has been read as
+// io.ErrUnexpectedEOF, since the entry is incomplete.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Find returns the offset of the first intact entry of the given version
+// that starts at or after from in r, which holds size bytes, or -1 if there
+// is none. It tells damage in the middle of a data file, which has intact
+// entries behind it, from a write torn at its end.
+func Find(r io.ReaderAt, version int, from, size int64) (int64, error) {
+	hsize := int64(headerSize(version))
+	buf := make([]byte, 64*1024)
+	// buf holds the n bytes of r from base on.
+	var base, n int64
+	for offset := from; offset+hsize <= size; offset++ {
+		if offset+hsize > base+n {
+			m, err := r.ReadAt(buf, offset)
+			if err != nil && err != io.EOF {
+				return -1, err
+			}
+			base, n = offset, int64(m)
+		}
+		header := buf[offset-base : offset-base+hsize]
+		e := decodeHeader(header, version)
+		esize := hsize + int64(e.KeySize) + int64(e.ValueSize)
+		if offset+esize > size {
+			continue
+		}
+		h := crc32.NewIEEE()
+		h.Write(header[4:])
+		if offset+esize <= base+n {
+			h.Write(buf[offset-base+hsize : offset-base+esize])
+		} else if _, err := io.Copy(h, io.NewSectionReader(r, offset+hsize, esize-hsize)); err != nil {
+			return -1, err
+		}
+		if h.Sum32() == e.CRC {
+			return offset, nil
+		}
+	}
+	return -1, nil
 }
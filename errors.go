@@ -0,0 +1,60 @@
+package bitcask
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNotFound      = errors.New("bitcask: key not found")
+	ErrKeyTooLarge   = errors.New("bitcask: key too large")
+	ErrValueTooLarge = errors.New("bitcask: value too large")
+
+	ErrCorrupted = errors.New("bitcask: corrupted entry")
+	ErrLocked    = errors.New("bitcask: directory locked by another process")
+	ErrUnordered = errors.New("bitcask: keydir is not ordered")
+	ErrConflict  = errors.New("bitcask: version conflict")
+	ErrReadOnly  = errors.New("bitcask: read-only store")
+	ErrClosed    = errors.New("bitcask: store closed")
+	ErrEncrypted = errors.New("bitcask: encrypted entry and no key provider")
+	ErrCodec     = errors.New("bitcask: invalid codec id")
+
+	ErrReadOnlyTxn = errors.New("bitcask: read-only transaction")
+)
+
+// CorruptedError reports a data file entry that failed to decode or whose
+// CRC does not match. It matches ErrCorrupted with errors.Is.
+type CorruptedError struct {
+	FileID uint32
+	Offset uint64
+	Err    error
+}
+
+func (e *CorruptedError) Error() string {
+	return fmt.Sprintf("bitcask: corrupted entry, fileID = %d, offset = %d: %v", e.FileID, e.Offset, e.Err)
+}
+
+func (e *CorruptedError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CorruptedError) Is(target error) bool {
+	return target == ErrCorrupted
+}
+
+// ConflictError reports a conditional write whose expected version of a
+// key did not match its current version, zero for a missing key. It
+// matches ErrConflict with errors.Is.
+type ConflictError struct {
+	Key      []byte
+	Expected uint64
+	Actual   uint64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("bitcask: version conflict, key = %q, expected = %d, actual = %d", e.Key, e.Expected, e.Actual)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
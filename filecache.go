@@ -0,0 +1,166 @@
+package bitcask
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// fileCache holds the data files opened for reading and closes the least
+// recently used ones beyond maxOpen, zero meaning no limit. Files are
+// reference counted: one that is evicted or removed while reads are using
+// it is closed by the last of them, so the limit may be exceeded by the
+// files of reads in progress.
+type fileCache struct {
+	dir     string
+	maxOpen int
+	// group makes concurrent misses on a file open it once.
+	group singleflight.Group
+
+	mu    sync.Mutex
+	files map[uint32]*list.Element
+	lru   *list.List
+	// removed holds the data files removed by a merge, so that a file
+	// opened just before its removal is not cached after it. File IDs are
+	// never reused.
+	removed map[uint32]bool
+}
+
+func newFileCache(dir string, maxOpen int) *fileCache {
+	return &fileCache{
+		dir:     dir,
+		maxOpen: maxOpen,
+		files:   make(map[uint32]*list.Element),
+		lru:     list.New(),
+		removed: make(map[uint32]bool),
+	}
+}
+
+// get returns the data file fileID, opening it if need be. Every file
+// returned must be given back with release.
+func (cache *fileCache) get(fileID uint32) (*dataFile, error) {
+	for {
+		cache.mu.Lock()
+		if elem, ok := cache.files[fileID]; ok {
+			file := elem.Value.(*dataFile)
+			file.refs++
+			cache.lru.MoveToFront(elem)
+			cache.mu.Unlock()
+			return file, nil
+		}
+		cache.mu.Unlock()
+
+		// The file is looked up again, as it may be evicted before this
+		// caller gets to it.
+		_, err, _ := cache.group.Do(strconv.FormatUint(uint64(fileID), 10), func() (interface{}, error) {
+			file, err := openReadFile(dataFilepath(cache.dir, fileID))
+			if err != nil {
+				return nil, err
+			}
+			cache.put(fileID, file)
+			return nil, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// release gives back a file returned by get.
+func (cache *fileCache) release(file *dataFile) {
+	cache.mu.Lock()
+	file.refs--
+	closing := file.refs == 0 && file.evicted
+	cache.mu.Unlock()
+	if closing {
+		file.Close()
+	}
+}
+
+// put adds an open data file, evicting the least recently used files if
+// there are too many. A file that has been removed in the meantime is
+// closed instead.
+func (cache *fileCache) put(fileID uint32, file *dataFile) {
+	var closing []*dataFile
+	file.fileID = fileID
+	cache.mu.Lock()
+	if cache.removed[fileID] {
+		cache.mu.Unlock()
+		file.Close()
+		return
+	}
+	if elem, ok := cache.files[fileID]; ok {
+		if old := cache.evictLocked(elem); old != nil {
+			closing = append(closing, old)
+		}
+	}
+	cache.files[fileID] = cache.lru.PushFront(file)
+	for cache.maxOpen > 0 && cache.lru.Len() > cache.maxOpen {
+		if old := cache.evictLocked(cache.lru.Back()); old != nil {
+			closing = append(closing, old)
+		}
+	}
+	cache.mu.Unlock()
+	for _, file := range closing {
+		file.Close()
+	}
+}
+
+// remove closes the data file fileID once no read is using it, and keeps
+// it from being cached again.
+func (cache *fileCache) remove(fileID uint32) error {
+	cache.mu.Lock()
+	cache.removed[fileID] = true
+	elem, ok := cache.files[fileID]
+	var file *dataFile
+	if ok {
+		file = cache.evictLocked(elem)
+	}
+	cache.mu.Unlock()
+	if file == nil {
+		return nil
+	}
+	return file.Close()
+}
+
+// evictLocked drops elem from the cache and returns its file if no read is
+// using it, in which case the caller closes it.
+func (cache *fileCache) evictLocked(elem *list.Element) *dataFile {
+	file := cache.lru.Remove(elem).(*dataFile)
+	delete(cache.files, file.fileID)
+	file.evicted = true
+	if file.refs > 0 {
+		return nil
+	}
+	return file
+}
+
+// close closes every data file. It must not be called with reads in
+// progress.
+func (cache *fileCache) close() error {
+	cache.mu.Lock()
+	var files []*dataFile
+	for _, elem := range cache.files {
+		if file := cache.evictLocked(elem); file != nil {
+			files = append(files, file)
+		}
+	}
+	cache.mu.Unlock()
+
+	var err error
+	for _, file := range files {
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// len returns the number of open data files in the cache.
+func (cache *fileCache) len() int {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.lru.Len()
+}
@@ -0,0 +1,114 @@
+package bitcask
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxOpenFiles(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithMaxFileSize(256))
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	n := 256
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		err = bitcask.Put(ctx, []byte(key), []byte(key))
+		assert.Nil(t, err)
+	}
+	assert.True(t, bitcask.fileID > 8)
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	// open
+	bitcask, err = Open(dir, WithMaxFileSize(256), WithMaxOpenFiles(4))
+	assert.Nil(t, err)
+	defer bitcask.Close()
+	assert.True(t, bitcask.rfiles.len() <= 4)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				key := strconv.Itoa(i)
+				value, err := bitcask.Get(ctx, []byte(key))
+				assert.Nil(t, err)
+				assert.Equal(t, key, string(value))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, bitcask.rfiles.len(), 4)
+}
+
+func TestFileCacheRefs(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithMaxFileSize(64))
+	assert.Nil(t, err)
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		key := strconv.Itoa(i)
+		err = bitcask.Put(ctx, []byte(key), []byte(key))
+		assert.Nil(t, err)
+	}
+	assert.True(t, bitcask.fileID > 2)
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	cache := newFileCache(dir, 1)
+	file, err := cache.get(1)
+	assert.Nil(t, err)
+	again, err := cache.get(1)
+	assert.Nil(t, err)
+	assert.True(t, file == again)
+	cache.release(again)
+
+	// evicted but still in use
+	other, err := cache.get(2)
+	assert.Nil(t, err)
+	cache.release(other)
+	assert.Equal(t, cache.len(), 1)
+	_, err = file.Stat()
+	assert.Nil(t, err)
+
+	cache.release(file)
+	_, err = file.Stat()
+	assert.NotNil(t, err)
+
+	err = cache.close()
+	assert.Nil(t, err)
+	_, err = other.Stat()
+	assert.NotNil(t, err)
+}
+
+func TestFileCacheRemoved(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir)
+	assert.Nil(t, err)
+	err = bitcask.Put(context.Background(), []byte("key"), []byte("value"))
+	assert.Nil(t, err)
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	// a file opened before a merge removes it and put after
+	cache := newFileCache(dir, 0)
+	file, err := openReadFile(dataFilepath(dir, 1))
+	assert.Nil(t, err)
+	err = cache.remove(1)
+	assert.Nil(t, err)
+	cache.put(1, file)
+	assert.Equal(t, cache.len(), 0)
+	_, err = file.Stat()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,9 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package bitcask
+
+// syncDir does nothing on platforms where directories cannot be synced.
+func syncDir(dir string) error {
+	return nil
+}
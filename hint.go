@@ -0,0 +1,155 @@
+package bitcask
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/decimalbell/bitcask/entry"
+	"github.com/decimalbell/bitcask/hint"
+)
+
+var (
+	errStaleHint       = errors.New("bitcask: stale hint file")
+	errInvalidFilename = errors.New("bitcask: invalid filename")
+)
+
+func hintFileID(name string) (uint32, error) {
+	return fileID(name, hintFilenamePrefix)
+}
+
+func hintFilepath(dir string, fileID uint32) string {
+	filename := hintFilenamePrefix + strconv.FormatUint(uint64(fileID), 10)
+	return filepath.Join(dir, filename)
+}
+
+// loadHintFile fills keydir from the hint file of a data file and returns
+// the highest sequence number in it. Nothing is applied unless the whole
+// hint file is intact and matches the data file.
+func loadHintFile(dir string, fileID uint32, keydir keydir, options *Options) (uint64, error) {
+	buf, err := ioutil.ReadFile(hintFilepath(dir, fileID))
+	if err != nil {
+		return 0, err
+	}
+	dataSize, hints, err := hint.Decode(buf)
+	if err != nil {
+		return 0, err
+	}
+	fileInfo, err := os.Stat(dataFilepath(dir, fileID))
+	if err != nil {
+		return 0, err
+	}
+	if fileInfo.Size() != dataSize {
+		return 0, errStaleHint
+	}
+
+	// Keys are decrypted up front, so that a hint file with a key that
+	// fails to decrypt is not applied in part.
+	keys := make([]string, len(hints))
+	for i := range hints {
+		h := &hints[i]
+		offset := h.ValueOffset + uint64(h.ValueSize) - uint64(h.EntrySize)
+		key, err := options.crypter.openKey(h.KeyID(), fileID, offset, h.Key)
+		if err != nil {
+			return 0, err
+		}
+		keys[i] = string(key)
+	}
+
+	var seq uint64
+	now := uint32(time.Now().Unix())
+	for i := range hints {
+		h := &hints[i]
+		if h.Seq > seq {
+			seq = h.Seq
+		}
+		key := keys[i]
+		if h.IsDeleted() || (h.Expiry != 0 && h.Expiry <= now) {
+			keydir.Delete(key)
+			continue
+		}
+		item := &item{
+			fileID:      fileID,
+			valueSize:   h.ValueSize,
+			valueOffset: h.ValueOffset,
+			entrySize:   h.EntrySize,
+			timestamp:   h.Timestamp,
+			expiry:      h.Expiry,
+			version:     h.Seq,
+		}
+		keydir.Put(key, item)
+	}
+	return seq, nil
+}
+
+// writeHintFile builds the hint file of an immutable data file. Damaged
+// entries are skipped if the corruption policy is to skip them, otherwise
+// no hint file is written and the next open deals with the data file.
+func writeHintFile(dir string, fileID uint32, options *Options) error {
+	file, err := os.Open(dataFilepath(dir, fileID))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	path := hintFilepath(dir, fileID)
+	hfile, err := os.OpenFile(path+tmpFilenameSuffix, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path + tmpFilenameSuffix)
+	defer hfile.Close()
+
+	w, err := hint.NewWriter(hfile)
+	if err != nil {
+		return err
+	}
+	policy := CorruptionFail
+	if options.corruptionPolicy == CorruptionSkip {
+		policy = CorruptionSkip
+	}
+	offset, err := scanDataFile(file, fileID, options, policy, false, func(e *entry.Entry, offset uint64) error {
+		key, err := options.crypter.sealKey(e.KeyID(), fileID, offset, e.Key)
+		if err != nil {
+			return err
+		}
+		h := &hint.Hint{
+			Timestamp:   e.Timestamp,
+			Flags:       e.Flags,
+			ValueSize:   e.ValueSize,
+			ValueOffset: offset + uint64(e.Size()) - uint64(e.ValueSize),
+			EntrySize:   uint32(e.Size()),
+			Expiry:      e.Expiry,
+			Seq:         e.Seq,
+			Key:         key,
+		}
+		return w.Write(h)
+	})
+	if err != nil {
+		return err
+	}
+	if err := w.Close(int64(offset)); err != nil {
+		return err
+	}
+	if err := hfile.Sync(); err != nil {
+		return err
+	}
+	if err := hfile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+tmpFilenameSuffix, path)
+}
+
+// writeHintFileAsync builds a hint file in the background. Hint files only
+// speed up open, so a failure just leaves the data file to be loaded in
+// full next time.
+func (bitcask *Bitcask) writeHintFileAsync(fileID uint32) {
+	bitcask.wg.Add(1)
+	go func() {
+		defer bitcask.wg.Done()
+		writeHintFile(bitcask.dir, fileID, bitcask.options)
+	}()
+}
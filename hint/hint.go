@@ -0,0 +1,182 @@
+package hint
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/decimalbell/bitcask/entry"
+)
+
+// A hint file starts with a header of magic and version, followed by one
+// record per data file entry and a trailer holding the size of the data
+// file it describes and a CRC32 of everything before the CRC. Version2
+// records hold 32-bit value offsets, Version3 records 64-bit ones,
+// Version4 records add an expiry time and Version5 records a sequence
+// number.
+const (
+	Magic   = 0x746e6968 // "hint"
+	Version = Version5
+
+	Version2 = 2
+	Version3 = 3
+	Version4 = 4
+	Version5 = 5
+
+	headerSize   = 8
+	recordSizeV2 = 24
+	recordSizeV3 = 28
+	recordSizeV4 = 32
+	recordSize   = 40
+	trailerSize  = 12
+)
+
+var (
+	ErrInvalidHeader = errors.New("hint: invalid header")
+	ErrInvalidCRC    = errors.New("hint: invalid crc")
+)
+
+type Hint struct {
+	Timestamp   uint32
+	Flags       uint32
+	KeySize     uint32
+	ValueSize   uint32
+	ValueOffset uint64
+	EntrySize   uint32
+	Expiry      uint32
+	Seq         uint64
+	Key         []byte
+}
+
+func (h *Hint) IsDeleted() bool {
+	return h.Flags&entry.FlagTombstone != 0
+}
+
+// KeyID returns the ID of the key the key of the record is encrypted with,
+// or zero if it is not encrypted.
+func (h *Hint) KeyID() uint16 {
+	return uint16((h.Flags & entry.FlagKeyID) >> 16)
+}
+
+type Writer struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+}
+
+func NewWriter(w io.Writer) (*Writer, error) {
+	crc := crc32.NewIEEE()
+	hw := &Writer{
+		w:   bufio.NewWriter(io.MultiWriter(w, crc)),
+		crc: crc,
+	}
+	buf := make([]byte, headerSize)
+	binary.LittleEndian.PutUint32(buf[0:], Magic)
+	binary.LittleEndian.PutUint32(buf[4:], Version)
+	if _, err := hw.w.Write(buf); err != nil {
+		return nil, err
+	}
+	return hw, nil
+}
+
+func (w *Writer) Write(h *Hint) error {
+	buf := make([]byte, recordSize+len(h.Key))
+	binary.LittleEndian.PutUint32(buf[0:], h.Timestamp)
+	binary.LittleEndian.PutUint32(buf[4:], h.Flags)
+	binary.LittleEndian.PutUint32(buf[8:], uint32(len(h.Key)))
+	binary.LittleEndian.PutUint32(buf[12:], h.ValueSize)
+	binary.LittleEndian.PutUint32(buf[16:], h.EntrySize)
+	binary.LittleEndian.PutUint64(buf[20:], h.ValueOffset)
+	binary.LittleEndian.PutUint32(buf[28:], h.Expiry)
+	binary.LittleEndian.PutUint64(buf[32:], h.Seq)
+	copy(buf[recordSize:], h.Key)
+	_, err := w.w.Write(buf)
+	return err
+}
+
+// Close writes the trailer and flushes buffered data. It does not close the
+// underlying writer.
+func (w *Writer) Close(dataSize int64) error {
+	buf := make([]byte, trailerSize)
+	binary.LittleEndian.PutUint64(buf[0:], uint64(dataSize))
+	if _, err := w.w.Write(buf[:8]); err != nil {
+		return err
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(buf[8:], w.crc.Sum32())
+	if _, err := w.w.Write(buf[8:]); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+// Decode verifies the checksum of a whole hint file and returns the size of
+// the data file it describes along with its records.
+func Decode(buf []byte) (int64, []Hint, error) {
+	if len(buf) < headerSize+trailerSize {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	if binary.LittleEndian.Uint32(buf[0:4]) != Magic {
+		return 0, nil, ErrInvalidHeader
+	}
+	version := binary.LittleEndian.Uint32(buf[4:8])
+	var size int
+	switch version {
+	case Version2:
+		size = recordSizeV2
+	case Version3:
+		size = recordSizeV3
+	case Version4:
+		size = recordSizeV4
+	case Version5:
+		size = recordSize
+	default:
+		return 0, nil, ErrInvalidHeader
+	}
+	n := len(buf) - 4
+	if crc32.ChecksumIEEE(buf[:n]) != binary.LittleEndian.Uint32(buf[n:]) {
+		return 0, nil, ErrInvalidCRC
+	}
+	dataSize := int64(binary.LittleEndian.Uint64(buf[n-8 : n]))
+
+	var hints []Hint
+	buf = buf[headerSize : n-8]
+	for len(buf) > 0 {
+		if len(buf) < size {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		keySize := binary.LittleEndian.Uint32(buf[8:12])
+		if uint64(len(buf)-size) < uint64(keySize) {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		h := Hint{
+			Timestamp: binary.LittleEndian.Uint32(buf[0:4]),
+			Flags:     binary.LittleEndian.Uint32(buf[4:8]),
+			KeySize:   keySize,
+			ValueSize: binary.LittleEndian.Uint32(buf[12:16]),
+			Key:       buf[size : size+int(keySize)],
+		}
+		if version == Version2 {
+			h.ValueOffset = uint64(binary.LittleEndian.Uint32(buf[16:20]))
+			h.EntrySize = binary.LittleEndian.Uint32(buf[20:24])
+		} else {
+			h.EntrySize = binary.LittleEndian.Uint32(buf[16:20])
+			h.ValueOffset = binary.LittleEndian.Uint64(buf[20:28])
+		}
+		if version >= Version4 {
+			h.Expiry = binary.LittleEndian.Uint32(buf[28:32])
+		}
+		if version >= Version5 {
+			h.Seq = binary.LittleEndian.Uint64(buf[32:40])
+		} else {
+			h.Seq = 1
+		}
+		hints = append(hints, h)
+		buf = buf[size+int(keySize):]
+	}
+	return dataSize, hints, nil
+}
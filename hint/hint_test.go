@@ -0,0 +1,73 @@
+package hint
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteDecode(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	assert.Nil(t, err)
+
+	h := &Hint{
+		Timestamp:   1,
+		Flags:       2,
+		KeySize:     3,
+		ValueSize:   4,
+		ValueOffset: 1 << 40,
+		EntrySize:   5,
+		Expiry:      6,
+		Seq:         7,
+		Key:         []byte("key"),
+	}
+	err = w.Write(h)
+	assert.Nil(t, err)
+	err = w.Close(1 << 41)
+	assert.Nil(t, err)
+
+	dataSize, hints, err := Decode(buf.Bytes())
+	assert.Nil(t, err)
+	assert.EqualValues(t, dataSize, 1<<41)
+	assert.Equal(t, hints, []Hint{*h})
+
+	b := buf.Bytes()
+	b[headerSize] ^= 0xff
+	_, _, err = Decode(b)
+	assert.Equal(t, err, ErrInvalidCRC)
+}
+
+func TestDecodeVersion2(t *testing.T) {
+	buf := make([]byte, headerSize+recordSizeV2+3+trailerSize)
+	binary.LittleEndian.PutUint32(buf[0:], Magic)
+	binary.LittleEndian.PutUint32(buf[4:], Version2)
+	record := buf[headerSize:]
+	binary.LittleEndian.PutUint32(record[0:], 1)
+	binary.LittleEndian.PutUint32(record[4:], 2)
+	binary.LittleEndian.PutUint32(record[8:], 3)
+	binary.LittleEndian.PutUint32(record[12:], 4)
+	binary.LittleEndian.PutUint32(record[16:], 5)
+	binary.LittleEndian.PutUint32(record[20:], 6)
+	copy(record[recordSizeV2:], "key")
+	n := len(buf) - 4
+	binary.LittleEndian.PutUint64(buf[n-8:], 7)
+	binary.LittleEndian.PutUint32(buf[n:], crc32.ChecksumIEEE(buf[:n]))
+
+	dataSize, hints, err := Decode(buf)
+	assert.Nil(t, err)
+	assert.EqualValues(t, dataSize, 7)
+	assert.Equal(t, hints, []Hint{{
+		Timestamp:   1,
+		Flags:       2,
+		KeySize:     3,
+		ValueSize:   4,
+		ValueOffset: 5,
+		EntrySize:   6,
+		Seq:         1,
+		Key:         []byte("key"),
+	}})
+}
@@ -0,0 +1,97 @@
+package bitcask
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHintFile(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithMaxFileSize(256))
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	n := 128
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		err = bitcask.Put(ctx, []byte(key), []byte(key))
+		assert.Nil(t, err)
+	}
+	m := 64
+	for i := 0; i < m; i++ {
+		key := strconv.Itoa(i)
+		err = bitcask.Delete(ctx, []byte(key))
+		assert.Nil(t, err)
+	}
+	fileID := bitcask.fileID
+	assert.True(t, fileID > 1)
+
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	for i := uint32(1); i < fileID; i++ {
+		_, err := os.Stat(hintFilepath(dir, i))
+		assert.Nil(t, err)
+	}
+	_, err = os.Stat(hintFilepath(dir, fileID))
+	assert.True(t, os.IsNotExist(err))
+
+	// open
+	bitcask, err = Open(dir, WithMaxFileSize(256))
+	assert.Nil(t, err)
+	assert.Equal(t, bitcask.rfiles.len(), 1)
+	assert.Equal(t, bitcask.Len(), n-m)
+	for i := m; i < n; i++ {
+		key := strconv.Itoa(i)
+		value, err := bitcask.Get(ctx, []byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, key, string(value))
+	}
+}
+
+func TestHintFileCorrupted(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithMaxFileSize(64))
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	n := 16
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		err = bitcask.Put(ctx, []byte(key), []byte(key))
+		assert.Nil(t, err)
+	}
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	path := hintFilepath(dir, 1)
+	buf, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	buf[len(buf)/2] ^= 0xff
+	err = ioutil.WriteFile(path, buf, 0644)
+	assert.Nil(t, err)
+
+	// open falls back to the data file and rewrites the hint
+	bitcask, err = Open(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, bitcask.Len(), n)
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		value, err := bitcask.Get(ctx, []byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, key, string(value))
+	}
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	rewritten, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.NotEqual(t, buf, rewritten)
+}
@@ -3,6 +3,15 @@ package bitcask
 type item struct {
 	fileID      uint32
 	valueSize   uint32
-	valueOffset uint32
+	valueOffset uint64
+	entrySize   uint32
 	timestamp   uint32
+	expiry      uint32
+	version     uint64
+}
+
+// expired reports whether the item has expired at now, a Unix time in
+// seconds.
+func (item *item) expired(now uint32) bool {
+	return item.expiry != 0 && item.expiry <= now
 }
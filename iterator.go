@@ -0,0 +1,198 @@
+package bitcask
+
+import (
+	"context"
+	"time"
+)
+
+// ItemMeta describes a stored value without reading it.
+type ItemMeta struct {
+	// ValueSize is the size of the value as stored, after compression.
+	// An encrypted value also counts the nonce and tag encryption adds, 28
+	// bytes with AES-GCM.
+	ValueSize uint32
+	Timestamp uint32
+	// Expiry is the Unix time in seconds the value expires at, or zero if
+	// it never does.
+	Expiry  uint32
+	Version uint64
+}
+
+// ForEach calls fn with every key and the metadata of its value, in no
+// particular order, skipping expired keys. The keys and metadata are taken
+// at a single point in time when ForEach is called, so writes made while it
+// runs are not seen. ForEach stops at the first error returned by fn, or
+// when ctx is done, and returns that error.
+func (bitcask *Bitcask) ForEach(ctx context.Context, fn func(key []byte, meta ItemMeta) error) error {
+	keys, items, err := bitcask.items()
+	if err != nil {
+		return err
+	}
+	now := uint32(time.Now().Unix())
+	for i, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if items[i].expired(now) {
+			continue
+		}
+		meta := ItemMeta{
+			ValueSize: items[i].valueSize,
+			Timestamp: items[i].timestamp,
+			Expiry:    items[i].expiry,
+			Version:   items[i].version,
+		}
+		if err := fn([]byte(key), meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Keys returns every key that has not expired, in no particular order, as
+// of a single point in time.
+func (bitcask *Bitcask) Keys(ctx context.Context) ([][]byte, error) {
+	keys, items, err := bitcask.items()
+	if err != nil {
+		return nil, err
+	}
+	now := uint32(time.Now().Unix())
+	result := make([][]byte, 0, len(keys))
+	for i, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if items[i].expired(now) {
+			continue
+		}
+		result = append(result, []byte(key))
+	}
+	return result, nil
+}
+
+// Iterator walks the keys present when it was created and reads the value
+// of each key as it is visited. A key deleted after the iterator was
+// created is skipped, and a key written after it was created is visited
+// with its latest value if it was already present, and not at all
+// otherwise.
+type Iterator struct {
+	ctx context.Context
+	// get returns the value of key and its item, or a nil item if the
+	// key is missing.
+	get func(ctx context.Context, key []byte) ([]byte, *item, error)
+
+	keys []string
+	i    int
+
+	key   []byte
+	value []byte
+	err   error
+}
+
+// NewIterator returns an iterator over all keys. If the store is closed,
+// the iterator stops right away with ErrClosed.
+func (bitcask *Bitcask) NewIterator(ctx context.Context) *Iterator {
+	keys, _, err := bitcask.items()
+	return &Iterator{
+		ctx:  ctx,
+		get:  bitcask.get,
+		keys: keys,
+		err:  err,
+	}
+}
+
+// items returns every key with its item, or ErrClosed.
+func (bitcask *Bitcask) items() ([]string, []*item, error) {
+	if err := bitcask.acquire(); err != nil {
+		return nil, nil, err
+	}
+	defer bitcask.release()
+
+	keys, items := bitcask.keydir.Items()
+	return keys, items, nil
+}
+
+// Scan returns an iterator over the keys in [start, end), in ascending
+// order or descending if reverse is set. A nil start or end leaves that side
+// unbounded and a limit of zero or less means no limit. The limit counts
+// only keys that have not expired. The keys are taken when Scan is called,
+// like NewIterator. Scan returns ErrUnordered unless the store was opened
+// WithOrderedKeydir.
+func (bitcask *Bitcask) Scan(ctx context.Context, start, end []byte, limit int, reverse bool) (*Iterator, error) {
+	kd, ok := bitcask.keydir.(orderedKeydir)
+	if !ok {
+		return nil, ErrUnordered
+	}
+	if err := bitcask.acquire(); err != nil {
+		return nil, err
+	}
+	defer bitcask.release()
+
+	keys, _ := kd.Scan(start, end, limit, reverse, uint32(time.Now().Unix()))
+	return &Iterator{
+		ctx:  ctx,
+		get:  bitcask.get,
+		keys: keys,
+	}, nil
+}
+
+// PrefixScan returns an iterator over the keys starting with prefix, like
+// Scan.
+func (bitcask *Bitcask) PrefixScan(ctx context.Context, prefix []byte, limit int, reverse bool) (*Iterator, error) {
+	return bitcask.Scan(ctx, prefix, prefixEnd(prefix), limit, reverse)
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i] += 1
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// Next advances the iterator to the next key and reads its value. It
+// returns false when there are no more keys or an error occurred.
+func (it *Iterator) Next() bool {
+	for it.err == nil && it.i < len(it.keys) {
+		if err := it.ctx.Err(); err != nil {
+			it.err = err
+			break
+		}
+		key := []byte(it.keys[it.i])
+		it.i += 1
+		value, item, err := it.get(it.ctx, key)
+		if err != nil {
+			it.err = err
+			break
+		}
+		// A nil value may well be an empty one, only a nil item tells
+		// the key is gone.
+		if item == nil {
+			continue
+		}
+		it.key = key
+		it.value = value
+		return true
+	}
+	it.key = nil
+	it.value = nil
+	return false
+}
+
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
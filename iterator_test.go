@@ -0,0 +1,232 @@
+package bitcask
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func putN(t *testing.T, bitcask *Bitcask, n int) {
+	ctx := context.Background()
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		err := bitcask.Put(ctx, []byte(key), []byte(key))
+		assert.Nil(t, err)
+	}
+}
+
+func TestForEach(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir)
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	n := 128
+	putN(t, bitcask, n)
+
+	ctx := context.Background()
+	seen := make(map[string]bool)
+	err = bitcask.ForEach(ctx, func(key []byte, meta ItemMeta) error {
+		assert.EqualValues(t, meta.ValueSize, len(key))
+		seen[string(key)] = true
+		// writes made during iteration are not seen
+		return bitcask.Put(ctx, []byte("new"+string(key)), key)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, len(seen), n)
+	for i := 0; i < n; i++ {
+		assert.True(t, seen[strconv.Itoa(i)])
+	}
+
+	errStop := errors.New("stop")
+	err = bitcask.ForEach(ctx, func(key []byte, meta ItemMeta) error {
+		return errStop
+	})
+	assert.Equal(t, err, errStop)
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	err = bitcask.ForEach(cctx, func(key []byte, meta ItemMeta) error {
+		return nil
+	})
+	assert.Equal(t, err, context.Canceled)
+}
+
+func TestKeys(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir)
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	n := 128
+	putN(t, bitcask, n)
+
+	keys, err := bitcask.Keys(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, len(keys), n)
+	sort.Slice(keys, func(i, j int) bool {
+		a, _ := strconv.Atoi(string(keys[i]))
+		b, _ := strconv.Atoi(string(keys[j]))
+		return a < b
+	})
+	for i := 0; i < n; i++ {
+		assert.Equal(t, string(keys[i]), strconv.Itoa(i))
+	}
+}
+
+func TestIterator(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir)
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	n := 128
+	putN(t, bitcask, n)
+
+	ctx := context.Background()
+	it := bitcask.NewIterator(ctx)
+
+	// changes made after the iterator was created
+	err = bitcask.Delete(ctx, []byte("0"))
+	assert.Nil(t, err)
+	err = bitcask.Put(ctx, []byte("1"), []byte("one"))
+	assert.Nil(t, err)
+	err = bitcask.Put(ctx, []byte("new"), []byte("new"))
+	assert.Nil(t, err)
+
+	values := make(map[string]string)
+	for it.Next() {
+		values[string(it.Key())] = string(it.Value())
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, len(values), n-1)
+	assert.Equal(t, values["1"], "one")
+	for i := 2; i < n; i++ {
+		key := strconv.Itoa(i)
+		assert.Equal(t, values[key], key)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	it = bitcask.NewIterator(cctx)
+	cancel()
+	assert.False(t, it.Next())
+	assert.Equal(t, it.Err(), context.Canceled)
+}
+
+func TestIteratorEmptyValue(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	// decrypting an empty value may well give a nil one
+	bitcask, err := Open(dir, WithEncryption(StaticKeys(1, map[uint16][]byte{1: make([]byte, 32)})))
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	ctx := context.Background()
+	err = bitcask.Put(ctx, []byte("empty"), nil)
+	assert.Nil(t, err)
+
+	snapshot, err := bitcask.Snapshot()
+	assert.Nil(t, err)
+	defer snapshot.Close()
+
+	for _, it := range []*Iterator{bitcask.NewIterator(ctx), snapshot.NewIterator(ctx)} {
+		var keys []string
+		for it.Next() {
+			keys = append(keys, string(it.Key()))
+			assert.Empty(t, it.Value())
+		}
+		assert.Nil(t, it.Err())
+		assert.Equal(t, []string{"empty"}, keys)
+	}
+}
+
+func TestScan(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithOrderedKeydir(true))
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	ctx := context.Background()
+	for _, key := range []string{"user:1", "user:42:a", "user:42:b", "user:43", "user:42:c"} {
+		err = bitcask.Put(ctx, []byte(key), []byte(key))
+		assert.Nil(t, err)
+	}
+
+	collect := func(it *Iterator) []string {
+		var keys []string
+		for it.Next() {
+			assert.Equal(t, it.Key(), it.Value())
+			keys = append(keys, string(it.Key()))
+		}
+		assert.Nil(t, it.Err())
+		return keys
+	}
+
+	it, err := bitcask.PrefixScan(ctx, []byte("user:42:"), 0, false)
+	assert.Nil(t, err)
+	assert.Equal(t, collect(it), []string{"user:42:a", "user:42:b", "user:42:c"})
+
+	it, err = bitcask.PrefixScan(ctx, []byte("user:42:"), 2, true)
+	assert.Nil(t, err)
+	assert.Equal(t, collect(it), []string{"user:42:c", "user:42:b"})
+
+	it, err = bitcask.Scan(ctx, []byte("user:2"), nil, 0, false)
+	assert.Nil(t, err)
+	assert.Equal(t, collect(it), []string{"user:42:a", "user:42:b", "user:42:c", "user:43"})
+}
+
+func TestScanExpired(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithOrderedKeydir(true))
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	ctx := context.Background()
+	for _, key := range []string{"a", "b"} {
+		err = bitcask.PutWithTTL(ctx, []byte(key), []byte(key), -time.Second)
+		assert.Nil(t, err)
+	}
+	for _, key := range []string{"c", "d"} {
+		err = bitcask.Put(ctx, []byte(key), []byte(key))
+		assert.Nil(t, err)
+	}
+
+	// the limit counts live keys only
+	it, err := bitcask.Scan(ctx, nil, nil, 2, false)
+	assert.Nil(t, err)
+	var keys []string
+	for it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, keys, []string{"c", "d"})
+}
+
+func TestScanUnordered(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir)
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	_, err = bitcask.Scan(context.Background(), nil, nil, 0, false)
+	assert.Equal(t, err, ErrUnordered)
+}
+
+func TestPrefixEnd(t *testing.T) {
+	assert.Equal(t, prefixEnd([]byte("ab")), []byte("ac"))
+	assert.Equal(t, prefixEnd([]byte{'a', 0xff}), []byte("b"))
+	assert.Nil(t, prefixEnd([]byte{0xff, 0xff}))
+	assert.Nil(t, prefixEnd(nil))
+}
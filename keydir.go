@@ -5,6 +5,33 @@ import (
 	"sync"
 )
 
+// keydir maps every live key to the location of its latest value.
+type keydir interface {
+	Get(key string) (*item, bool)
+	Put(key string, item *item)
+	Delete(key string)
+	// CompareAndSwap replaces the item stored for key with new if the
+	// current item is old, and reports whether the swap happened. A nil
+	// old matches a missing key and a nil new deletes the key.
+	CompareAndSwap(key string, old, new *item) bool
+	Len() int
+	// Items returns every key with its item. Each key is read as of a
+	// single point in time, but writes to several keys may be seen in
+	// part unless the caller keeps writers out.
+	Items() ([]string, []*item)
+}
+
+// orderedKeydir is a keydir that keeps its keys sorted.
+type orderedKeydir interface {
+	keydir
+	// Scan returns the keys in [start, end) with their items, in ascending
+	// order or descending if reverse is set, leaving out those expired at
+	// now, so that limit counts live keys only. A nil start or end leaves
+	// that side unbounded, a limit of zero or less means no limit and a now
+	// of zero keeps expired keys.
+	Scan(start, end []byte, limit int, reverse bool, now uint32) ([]string, []*item)
+}
+
 const n = 512
 
 type shard struct {
@@ -12,12 +39,13 @@ type shard struct {
 	m  map[string]*item
 }
 
-type keydir struct {
+// shardedKeydir is an unordered keydir of hash-sharded maps.
+type shardedKeydir struct {
 	shards [n]*shard
 }
 
-func NewKeydir() *keydir {
-	kd := new(keydir)
+func NewKeydir() keydir {
+	kd := new(shardedKeydir)
 	for i := 0; i < n; i++ {
 		kd.shards[i] = &shard{
 			m: make(map[string]*item),
@@ -26,13 +54,13 @@ func NewKeydir() *keydir {
 	return kd
 }
 
-func (kd *keydir) shard(key string) *shard {
+func (kd *shardedKeydir) shard(key string) *shard {
 	h := fnv.New64()
 	h.Write([]byte(key))
 	return kd.shards[h.Sum64()%n]
 }
 
-func (kd *keydir) Get(key string) (*item, bool) {
+func (kd *shardedKeydir) Get(key string) (*item, bool) {
 	shard := kd.shard(key)
 	shard.mu.RLock()
 	defer shard.mu.RUnlock()
@@ -41,7 +69,7 @@ func (kd *keydir) Get(key string) (*item, bool) {
 	return item, ok
 }
 
-func (kd *keydir) Put(key string, item *item) {
+func (kd *shardedKeydir) Put(key string, item *item) {
 	shard := kd.shard(key)
 	shard.mu.Lock()
 	defer shard.mu.Unlock()
@@ -49,7 +77,7 @@ func (kd *keydir) Put(key string, item *item) {
 	shard.m[key] = item
 }
 
-func (kd *keydir) Delete(key string) {
+func (kd *shardedKeydir) Delete(key string) {
 	shard := kd.shard(key)
 	shard.mu.Lock()
 	defer shard.mu.Unlock()
@@ -57,8 +85,24 @@ func (kd *keydir) Delete(key string) {
 	delete(shard.m, key)
 }
 
+func (kd *shardedKeydir) CompareAndSwap(key string, old, new *item) bool {
+	shard := kd.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if shard.m[key] != old {
+		return false
+	}
+	if new == nil {
+		delete(shard.m, key)
+	} else {
+		shard.m[key] = new
+	}
+	return true
+}
+
 // TODO: performance optimization
-func (kd *keydir) Len() int {
+func (kd *shardedKeydir) Len() int {
 	l := 0
 	for i := 0; i < n; i++ {
 		shard := kd.shards[i]
@@ -68,3 +112,27 @@ func (kd *keydir) Len() int {
 	}
 	return l
 }
+
+// Items locks all shards while they are copied, so a concurrent write to a
+// key is either seen or not. Writes to several keys may be seen in part.
+func (kd *shardedKeydir) Items() ([]string, []*item) {
+	for i := 0; i < n; i++ {
+		kd.shards[i].mu.RLock()
+	}
+	l := 0
+	for i := 0; i < n; i++ {
+		l += len(kd.shards[i].m)
+	}
+	keys := make([]string, 0, l)
+	items := make([]*item, 0, l)
+	for i := 0; i < n; i++ {
+		for key, item := range kd.shards[i].m {
+			keys = append(keys, key)
+			items = append(items, item)
+		}
+	}
+	for i := 0; i < n; i++ {
+		kd.shards[i].mu.RUnlock()
+	}
+	return keys, items
+}
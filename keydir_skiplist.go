@@ -0,0 +1,227 @@
+package bitcask
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	skiplistMaxLevel = 32
+	skiplistP        = 4
+)
+
+type skiplistNode struct {
+	key  string
+	item *item
+	next []*skiplistNode
+	// prev links the bottom level backwards for reverse scans.
+	prev *skiplistNode
+}
+
+// skiplistKeydir is an ordered keydir backed by a skiplist behind a single
+// lock.
+type skiplistKeydir struct {
+	mu    sync.RWMutex
+	head  *skiplistNode
+	level int
+	len   int
+	rand  *rand.Rand
+}
+
+func NewOrderedKeydir() orderedKeydir {
+	return &skiplistKeydir{
+		head:  &skiplistNode{next: make([]*skiplistNode, skiplistMaxLevel)},
+		level: 1,
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (kd *skiplistKeydir) randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && kd.rand.Intn(skiplistP) == 0 {
+		level++
+	}
+	return level
+}
+
+// seek returns the last node with a key less than key, and fills update,
+// if not nil, with the last such node on every level.
+func (kd *skiplistKeydir) seek(key string, update []*skiplistNode) *skiplistNode {
+	x := kd.head
+	for i := kd.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		if update != nil {
+			update[i] = x
+		}
+	}
+	return x
+}
+
+func (kd *skiplistKeydir) find(key string) *skiplistNode {
+	x := kd.seek(key, nil).next[0]
+	if x != nil && x.key == key {
+		return x
+	}
+	return nil
+}
+
+func (kd *skiplistKeydir) last() *skiplistNode {
+	x := kd.head
+	for i := kd.level - 1; i >= 0; i-- {
+		for x.next[i] != nil {
+			x = x.next[i]
+		}
+	}
+	return x
+}
+
+func (kd *skiplistKeydir) Get(key string) (*item, bool) {
+	kd.mu.RLock()
+	defer kd.mu.RUnlock()
+
+	x := kd.find(key)
+	if x == nil {
+		return nil, false
+	}
+	return x.item, true
+}
+
+func (kd *skiplistKeydir) Put(key string, item *item) {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+
+	kd.put(key, item)
+}
+
+func (kd *skiplistKeydir) put(key string, item *item) {
+	var update [skiplistMaxLevel]*skiplistNode
+	x := kd.seek(key, update[:]).next[0]
+	if x != nil && x.key == key {
+		x.item = item
+		return
+	}
+
+	level := kd.randomLevel()
+	for i := kd.level; i < level; i++ {
+		update[i] = kd.head
+	}
+	if level > kd.level {
+		kd.level = level
+	}
+	x = &skiplistNode{
+		key:  key,
+		item: item,
+		next: make([]*skiplistNode, level),
+	}
+	for i := 0; i < level; i++ {
+		x.next[i] = update[i].next[i]
+		update[i].next[i] = x
+	}
+	x.prev = update[0]
+	if x.next[0] != nil {
+		x.next[0].prev = x
+	}
+	kd.len += 1
+}
+
+func (kd *skiplistKeydir) Delete(key string) {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+
+	kd.delete(key)
+}
+
+func (kd *skiplistKeydir) delete(key string) {
+	var update [skiplistMaxLevel]*skiplistNode
+	x := kd.seek(key, update[:]).next[0]
+	if x == nil || x.key != key {
+		return
+	}
+	for i := 0; i < len(x.next); i++ {
+		update[i].next[i] = x.next[i]
+	}
+	if x.next[0] != nil {
+		x.next[0].prev = x.prev
+	}
+	for kd.level > 1 && kd.head.next[kd.level-1] == nil {
+		kd.level--
+	}
+	kd.len -= 1
+}
+
+func (kd *skiplistKeydir) CompareAndSwap(key string, old, new *item) bool {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+
+	x := kd.find(key)
+	var current *item
+	if x != nil {
+		current = x.item
+	}
+	if current != old {
+		return false
+	}
+	if new == nil {
+		if x != nil {
+			kd.delete(key)
+		}
+	} else if x != nil {
+		x.item = new
+	} else {
+		kd.put(key, new)
+	}
+	return true
+}
+
+func (kd *skiplistKeydir) Len() int {
+	kd.mu.RLock()
+	defer kd.mu.RUnlock()
+
+	return kd.len
+}
+
+func (kd *skiplistKeydir) Items() ([]string, []*item) {
+	return kd.Scan(nil, nil, 0, false, 0)
+}
+
+func (kd *skiplistKeydir) Scan(start, end []byte, limit int, reverse bool, now uint32) ([]string, []*item) {
+	kd.mu.RLock()
+	defer kd.mu.RUnlock()
+
+	var (
+		keys  []string
+		items []*item
+	)
+	full := func() bool {
+		return limit > 0 && len(keys) >= limit
+	}
+	if !reverse {
+		x := kd.seek(string(start), nil).next[0]
+		for ; x != nil && (end == nil || x.key < string(end)) && !full(); x = x.next[0] {
+			if x.item.expired(now) {
+				continue
+			}
+			keys = append(keys, x.key)
+			items = append(items, x.item)
+		}
+		return keys, items
+	}
+
+	var x *skiplistNode
+	if end == nil {
+		x = kd.last()
+	} else {
+		x = kd.seek(string(end), nil)
+	}
+	for ; x != kd.head && (start == nil || x.key >= string(start)) && !full(); x = x.prev {
+		if x.item.expired(now) {
+			continue
+		}
+		keys = append(keys, x.key)
+		items = append(items, x.item)
+	}
+	return keys, items
+}
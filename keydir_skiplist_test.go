@@ -0,0 +1,96 @@
+package bitcask
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderedKeydir(t *testing.T) {
+	keydir := NewOrderedKeydir()
+	m := make(map[string]*item)
+	for i := 0; i < 4096; i++ {
+		key := fmt.Sprintf("%04d", rand.Intn(1024))
+		if rand.Intn(4) == 0 {
+			keydir.Delete(key)
+			delete(m, key)
+			continue
+		}
+		item := &item{fileID: uint32(i)}
+		keydir.Put(key, item)
+		m[key] = item
+	}
+	assert.Equal(t, keydir.Len(), len(m))
+
+	var keys []string
+	for key, item1 := range m {
+		item2, ok := keydir.Get(key)
+		assert.True(t, ok)
+		assert.Equal(t, item2, item1)
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	items, _ := keydir.Items()
+	assert.Equal(t, items, keys)
+}
+
+func TestOrderedKeydirCompareAndSwap(t *testing.T) {
+	keydir := NewOrderedKeydir()
+	key := "key"
+	item1 := &item{fileID: 1}
+	item2 := &item{fileID: 2}
+
+	assert.False(t, keydir.CompareAndSwap(key, item1, item2))
+	assert.True(t, keydir.CompareAndSwap(key, nil, item1))
+	assert.True(t, keydir.CompareAndSwap(key, item1, item2))
+	item, ok := keydir.Get(key)
+	assert.True(t, ok)
+	assert.Equal(t, item, item2)
+}
+
+func TestOrderedKeydirScan(t *testing.T) {
+	keydir := NewOrderedKeydir()
+	for _, key := range []string{"a", "b", "ba", "bb", "c", "d"} {
+		keydir.Put(key, &item{})
+	}
+
+	tests := []struct {
+		start, end []byte
+		limit      int
+		reverse    bool
+		keys       []string
+	}{
+		{nil, nil, 0, false, []string{"a", "b", "ba", "bb", "c", "d"}},
+		{nil, nil, 0, true, []string{"d", "c", "bb", "ba", "b", "a"}},
+		{[]byte("b"), []byte("c"), 0, false, []string{"b", "ba", "bb"}},
+		{[]byte("b"), []byte("c"), 0, true, []string{"bb", "ba", "b"}},
+		{[]byte("b"), []byte("c"), 2, false, []string{"b", "ba"}},
+		{[]byte("b"), []byte("c"), 2, true, []string{"bb", "ba"}},
+		{[]byte("bc"), nil, 0, false, []string{"c", "d"}},
+		{nil, []byte("b"), 0, true, []string{"a"}},
+		{[]byte("e"), nil, 0, false, nil},
+	}
+	for _, test := range tests {
+		keys, _ := keydir.Scan(test.start, test.end, test.limit, test.reverse, 0)
+		assert.Equal(t, keys, test.keys)
+	}
+}
+
+func BenchmarkOrderedKeydirPut(b *testing.B) {
+	keydir := NewOrderedKeydir()
+
+	keys := make([]string, b.N)
+	for i := 0; i < b.N; i++ {
+		keys[i] = fmt.Sprintf("%016d", rand.Int())
+	}
+	item := &item{}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		keydir.Put(keys[i], item)
+	}
+}
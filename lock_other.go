@@ -0,0 +1,25 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package bitcask
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// lockFile only creates the lock file on platforms without flock, it does
+// not keep other processes out. A shared lock does not even do that.
+func lockFile(dir string, shared bool) (*os.File, error) {
+	if shared {
+		return nil, nil
+	}
+	return os.OpenFile(filepath.Join(dir, lockFilename), os.O_CREATE|os.O_RDWR, 0644)
+}
+
+func unlockFile(file *os.File) error {
+	if file == nil {
+		return nil
+	}
+	return file.Close()
+}
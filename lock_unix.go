@@ -0,0 +1,55 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package bitcask
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockFile takes an flock on the lock file in dir without blocking. It
+// returns ErrLocked if another process holds a conflicting lock. A shared
+// lock never creates the lock file; if there is none, nothing is locked.
+func lockFile(dir string, shared bool) (*os.File, error) {
+	path := filepath.Join(dir, lockFilename)
+	var (
+		file *os.File
+		err  error
+	)
+	if shared {
+		file, err = os.Open(path)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+	} else {
+		file, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	}
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	if err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+func unlockFile(file *os.File) error {
+	if file == nil {
+		return nil
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_UN); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,322 @@
+package bitcask
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/decimalbell/bitcask/entry"
+	"github.com/decimalbell/bitcask/hint"
+)
+
+// Merge rewrites the live entries of all immutable data files into fresh
+// data files and removes the old ones, reclaiming the space taken by
+// overwritten, deleted and expired keys. The active file is rotated first, so every
+// entry written before Merge is called takes part. Gets, Puts and Deletes
+// keep running while a merge is in progress; concurrent merges run one
+// after another.
+func (bitcask *Bitcask) Merge(ctx context.Context) error {
+	if bitcask.options.readOnly {
+		return ErrReadOnly
+	}
+	if err := bitcask.acquire(); err != nil {
+		return err
+	}
+	defer bitcask.release()
+	bitcask.mergeMu.Lock()
+	defer bitcask.mergeMu.Unlock()
+
+	fileIDs, err := bitcask.rotateForMerge()
+	if err != nil {
+		return err
+	}
+	if len(fileIDs) == 0 {
+		return nil
+	}
+
+	// Merged files take the IDs between the last merged file and the new
+	// active file, so they are loaded after the files they replace and
+	// before anything written since.
+	last := fileIDs[len(fileIDs)-1]
+	m := &merger{
+		bitcask: bitcask,
+		nextID:  last + 1,
+		lastID:  last + uint32(len(fileIDs)),
+	}
+	for _, fileID := range fileIDs {
+		if err := m.mergeFile(ctx, fileID); err != nil {
+			m.abort()
+			return err
+		}
+	}
+	if err := m.flush(); err != nil {
+		m.abort()
+		return err
+	}
+
+	return bitcask.removeDataFiles(fileIDs)
+}
+
+// rotateForMerge rotates the active file past the IDs reserved for the
+// merged files and returns the IDs of the data files to merge. Files left
+// over from an earlier merge for snapshots to read are not merged again.
+func (bitcask *Bitcask) rotateForMerge() ([]uint32, error) {
+	bitcask.mu.Lock()
+	defer bitcask.mu.Unlock()
+
+	ids, err := dataFileIDs(bitcask.dir)
+	if err != nil {
+		return nil, err
+	}
+	bitcask.pinMu.Lock()
+	obsolete := make(map[uint32]bool)
+	for _, fileID := range bitcask.obsolete {
+		obsolete[fileID] = true
+	}
+	bitcask.pinMu.Unlock()
+	var fileIDs []uint32
+	for _, fileID := range ids {
+		if !obsolete[fileID] {
+			fileIDs = append(fileIDs, fileID)
+		}
+	}
+	if len(fileIDs) == 0 || (len(fileIDs) == 1 && bitcask.offset == 0) {
+		return nil, nil
+	}
+	fileID := bitcask.fileID + uint32(len(fileIDs)) + 1
+	if err := bitcask.rotateLocked(fileID); err != nil {
+		return nil, err
+	}
+	return fileIDs, nil
+}
+
+// removeDataFiles removes merged data files with their hint files and
+// closes their read handles. Files still read by a snapshot are kept until
+// it is closed.
+func (bitcask *Bitcask) removeDataFiles(fileIDs []uint32) error {
+	bitcask.pinMu.Lock()
+	defer bitcask.pinMu.Unlock()
+
+	bitcask.obsolete = append(bitcask.obsolete, fileIDs...)
+	return bitcask.removeObsoleteLocked()
+}
+
+// removeObsoleteLocked removes merged data files up to the first one a
+// snapshot still reads. Files are removed in ascending order so that a
+// crash never leaves a tombstone-free file behind an older value of the
+// same key.
+func (bitcask *Bitcask) removeObsoleteLocked() error {
+	for len(bitcask.obsolete) > 0 {
+		fileID := bitcask.obsolete[0]
+		if bitcask.pins[fileID] > 0 {
+			return nil
+		}
+		err := os.Remove(dataFilepath(bitcask.dir, fileID))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		err = os.Remove(hintFilepath(bitcask.dir, fileID))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		bitcask.rfiles.remove(fileID)
+		bitcask.obsolete = bitcask.obsolete[1:]
+	}
+	return nil
+}
+
+type swap struct {
+	key string
+	old *item
+	new *item
+}
+
+// merger copies live entries into merged data files. Each merged file and
+// its hint file are written under temporary names and only moved into
+// place, with the keydir pointed at them, once they are complete and synced.
+type merger struct {
+	bitcask *Bitcask
+	nextID  uint32
+	lastID  uint32
+
+	file   *os.File
+	hfile  *os.File
+	hint   *hint.Writer
+	fileID uint32
+	offset uint64
+	swaps  []swap
+}
+
+func (m *merger) mergeFile(ctx context.Context, fileID uint32) error {
+	file, err := os.Open(dataFilepath(m.bitcask.dir, fileID))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Damaged entries are skipped unless the policy is to fail; truncating
+	// would drop the intact entries behind them when the file is removed.
+	policy := m.bitcask.options.corruptionPolicy
+	if policy != CorruptionFail {
+		policy = CorruptionSkip
+	}
+	now := uint32(time.Now().Unix())
+	_, err = scanDataFile(file, fileID, m.bitcask.options, policy, false, func(e *entry.Entry, offset uint64) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if e.IsDeleted() {
+			return nil
+		}
+		key := string(e.Key)
+		item, ok := m.bitcask.keydir.Get(key)
+		if !ok || item.fileID != fileID || item.valueOffset != offset+uint64(e.Size())-uint64(e.ValueSize) {
+			return nil
+		}
+		// Every older entry of the key is merged too, so an expired entry
+		// can go along with its key.
+		if item.expired(now) {
+			m.bitcask.keydir.CompareAndSwap(key, item, nil)
+			return nil
+		}
+		return m.write(key, e, item)
+	})
+	return err
+}
+
+func (m *merger) write(key string, e *entry.Entry, old *item) error {
+	crypter := m.bitcask.options.crypter
+	n := uint64(entry.EncodedLen(e.Key, e.Value) + 2*crypter.overhead())
+	// The last reserved file takes whatever is left, even if that makes it
+	// larger than maxFileSize.
+	if m.file == nil || (m.offset+n > m.bitcask.options.maxFileSize && m.nextID <= m.lastID) {
+		if err := m.rotate(); err != nil {
+			return err
+		}
+	}
+
+	// Encrypted entries are encrypted again for their new place, with the
+	// current key.
+	id, skey, svalue, err := crypter.seal(m.fileID, m.offset, e.Key, e.Value)
+	if err != nil {
+		return err
+	}
+	flags := e.Flags&entry.FlagCodec | entry.KeyIDFlags(id)
+	buf := entry.Encode(skey, svalue, e.Timestamp, e.Expiry, e.Seq, flags)
+	if _, err := m.file.Write(buf); err != nil {
+		return err
+	}
+	m.offset += n
+	item := &item{
+		fileID:      m.fileID,
+		valueSize:   uint32(len(svalue)),
+		valueOffset: m.offset - uint64(len(svalue)),
+		entrySize:   uint32(n),
+		timestamp:   e.Timestamp,
+		expiry:      e.Expiry,
+		version:     e.Seq,
+	}
+	h := &hint.Hint{
+		Timestamp:   item.timestamp,
+		Flags:       flags,
+		ValueSize:   item.valueSize,
+		ValueOffset: item.valueOffset,
+		EntrySize:   item.entrySize,
+		Expiry:      item.expiry,
+		Seq:         item.version,
+		Key:         skey,
+	}
+	if err := m.hint.Write(h); err != nil {
+		return err
+	}
+	m.swaps = append(m.swaps, swap{key: key, old: old, new: item})
+	return nil
+}
+
+func (m *merger) rotate() error {
+	if err := m.flush(); err != nil {
+		return err
+	}
+	fileID := m.nextID
+	flag := os.O_CREATE | os.O_TRUNC | os.O_WRONLY
+	path := dataFilepath(m.bitcask.dir, fileID) + tmpFilenameSuffix
+	file, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return err
+	}
+	hpath := hintFilepath(m.bitcask.dir, fileID) + tmpFilenameSuffix
+	hfile, err := os.OpenFile(hpath, flag, 0644)
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	m.file = file
+	m.hfile = hfile
+	m.fileID = fileID
+	m.nextID += 1
+	m.offset = 0
+	m.hint, err = hint.NewWriter(hfile)
+	if err != nil {
+		return err
+	}
+	header := entry.EncodeFileHeader()
+	if _, err := file.Write(header); err != nil {
+		return err
+	}
+	m.offset = uint64(len(header))
+	return nil
+}
+
+// flush moves the current merged file into place and swaps the keydir
+// items of the entries copied into it, unless they changed in the meantime.
+func (m *merger) flush() error {
+	if m.file == nil {
+		return nil
+	}
+	if err := m.hint.Close(int64(m.offset)); err != nil {
+		return err
+	}
+	for _, file := range []*os.File{m.file, m.hfile} {
+		if err := file.Sync(); err != nil {
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+	m.file = nil
+	// The data file goes first: a data file without a hint is still
+	// loaded, a hint file without a data file is removed on open.
+	for _, path := range []string{
+		dataFilepath(m.bitcask.dir, m.fileID),
+		hintFilepath(m.bitcask.dir, m.fileID),
+	} {
+		if err := os.Rename(path+tmpFilenameSuffix, path); err != nil {
+			return err
+		}
+	}
+	// The renames must reach the disk before the merged files are removed.
+	if err := syncDir(m.bitcask.dir); err != nil {
+		return err
+	}
+
+	for _, s := range m.swaps {
+		if m.bitcask.keydir.CompareAndSwap(s.key, s.old, s.new) {
+			m.bitcask.cache.replace(s.key, s.old, s.new)
+		}
+	}
+	m.swaps = m.swaps[:0]
+	return nil
+}
+
+func (m *merger) abort() {
+	if m.file == nil {
+		return
+	}
+	m.file.Close()
+	m.hfile.Close()
+	os.Remove(dataFilepath(m.bitcask.dir, m.fileID) + tmpFilenameSuffix)
+	os.Remove(hintFilepath(m.bitcask.dir, m.fileID) + tmpFilenameSuffix)
+	m.file = nil
+}
@@ -0,0 +1,182 @@
+package bitcask
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func dirSize(t *testing.T, dir string) int64 {
+	fileIDs, err := dataFileIDs(dir)
+	assert.Nil(t, err)
+	var size int64
+	for _, fileID := range fileIDs {
+		fileInfo, err := os.Stat(dataFilepath(dir, fileID))
+		assert.Nil(t, err)
+		size += fileInfo.Size()
+	}
+	return size
+}
+
+func TestMerge(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithMaxFileSize(256))
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	n := 128
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		err = bitcask.Put(ctx, []byte(key), []byte("old"))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		err = bitcask.Put(ctx, []byte(key), []byte(key))
+		assert.Nil(t, err)
+	}
+	m := 64
+	for i := 0; i < m; i++ {
+		key := strconv.Itoa(i)
+		err = bitcask.Delete(ctx, []byte(key))
+		assert.Nil(t, err)
+	}
+
+	size := dirSize(t, dir)
+	err = bitcask.Merge(ctx)
+	assert.Nil(t, err)
+	assert.True(t, dirSize(t, dir) < size)
+	assert.Equal(t, bitcask.Len(), n-m)
+	assert.EqualValues(t, bitcask.offset, 0)
+
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		value, err := bitcask.Get(ctx, []byte(key))
+		assert.Nil(t, err)
+		if i < m {
+			assert.Nil(t, value)
+		} else {
+			assert.Equal(t, key, string(value))
+		}
+	}
+
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	// open
+	bitcask, err = Open(dir, WithMaxFileSize(256))
+	assert.Nil(t, err)
+	assert.Equal(t, bitcask.Len(), n-m)
+	for i := m; i < n; i++ {
+		key := strconv.Itoa(i)
+		value, err := bitcask.Get(ctx, []byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, key, string(value))
+	}
+}
+
+func TestMergeEmpty(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir)
+	assert.Nil(t, err)
+
+	err = bitcask.Merge(context.Background())
+	assert.Nil(t, err)
+	assert.EqualValues(t, bitcask.fileID, 1)
+}
+
+func TestMergeConcurrentPut(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithMaxFileSize(1024))
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	n := 1024
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		err = bitcask.Put(ctx, []byte(key), []byte("old"))
+		assert.Nil(t, err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			key := strconv.Itoa(i)
+			err := bitcask.Put(ctx, []byte(key), []byte(key))
+			assert.Nil(t, err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		err := bitcask.Merge(ctx)
+		assert.Nil(t, err)
+	}()
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		value, err := bitcask.Get(ctx, []byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, key, string(value))
+	}
+
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	// open
+	bitcask, err = Open(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, bitcask.Len(), n)
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		value, err := bitcask.Get(ctx, []byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, key, string(value))
+	}
+}
+
+func TestMergeExpired(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir)
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	ctx := context.Background()
+	n := 128
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		ttl := time.Hour
+		if i%2 == 0 {
+			ttl = -time.Second
+		}
+		err = bitcask.PutWithTTL(ctx, []byte(key), []byte(key), ttl)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, bitcask.Len(), n)
+
+	err = bitcask.Merge(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, bitcask.Len(), n/2)
+
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		value, err := bitcask.Get(ctx, []byte(key))
+		assert.Nil(t, err)
+		if i%2 == 0 {
+			assert.Nil(t, value)
+		} else {
+			assert.Equal(t, key, string(value))
+		}
+	}
+}
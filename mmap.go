@@ -0,0 +1,58 @@
+package bitcask
+
+import "os"
+
+// mmap maps the file into memory unless it has been tried before. It must
+// only be called once the file is no longer appended to, and while holding
+// a reference to it.
+func (file *dataFile) mmap() error {
+	var err error
+	file.once.Do(func() {
+		var fileInfo os.FileInfo
+		if fileInfo, err = file.Stat(); err != nil {
+			return
+		}
+		if size := fileInfo.Size(); size > 0 {
+			var data []byte
+			if data, err = mmapFile(file.File, int(size)); err == nil {
+				file.data.Store(data)
+			}
+		}
+	})
+	return err
+}
+
+// mapping returns the mapping of the file, or nil if it is not mapped.
+func (file *dataFile) mapping() []byte {
+	data, _ := file.data.Load().([]byte)
+	return data
+}
+
+// readAt calls fn with the n bytes at off. If they are in the mapping, buf
+// points into it and mapped is set; fn must then copy whatever it keeps,
+// since the mapping goes away with the file. Otherwise they are read with
+// ReadAt into a new buffer.
+func (file *dataFile) readAt(off int64, n int, fn func(buf []byte, mapped bool) error) error {
+	if data := file.mapping(); off >= 0 && off+int64(n) <= int64(len(data)) {
+		return fn(data[off:off+int64(n)], true)
+	}
+	buf := make([]byte, n)
+	if _, err := file.File.ReadAt(buf, off); err != nil {
+		return err
+	}
+	return fn(buf, false)
+}
+
+// Close unmaps and closes the file. The fileCache only closes a file no
+// read is using.
+func (file *dataFile) Close() error {
+	var err error
+	if data := file.mapping(); data != nil {
+		err = munmapFile(data)
+		file.data.Store([]byte(nil))
+	}
+	if cerr := file.File.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
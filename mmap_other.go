@@ -0,0 +1,16 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package bitcask
+
+import "os"
+
+// mmapFile maps nothing on platforms without mmap, so files are read with
+// ReadAt.
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	return nil, nil
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,137 @@
+package bitcask
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMmap(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithMaxFileSize(1024), WithMmap(true))
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	ctx := context.Background()
+	n := 256
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		err = bitcask.Put(ctx, []byte(key), []byte(key))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		value, err := bitcask.Get(ctx, []byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, key, string(value))
+		// values are copied out of the mapping
+		value[0] = 'x'
+	}
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		value, err := bitcask.Get(ctx, []byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, key, string(value))
+	}
+
+	elem, ok := bitcask.rfiles.files[1]
+	assert.True(t, ok)
+	assert.NotNil(t, elem.Value.(*dataFile).mapping())
+	elem, ok = bitcask.rfiles.files[bitcask.fileID]
+	assert.True(t, ok)
+	assert.Nil(t, elem.Value.(*dataFile).mapping())
+}
+
+func TestMmapEmptyValue(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithMaxFileSize(64), WithMmap(true))
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	ctx := context.Background()
+	err = bitcask.Put(ctx, []byte("empty"), []byte{})
+	assert.Nil(t, err)
+	err = bitcask.Put(ctx, []byte("rotate"), []byte("rotate"))
+	assert.Nil(t, err)
+	assert.True(t, bitcask.fileID > 1)
+
+	value, err := bitcask.Get(ctx, []byte("empty"))
+	assert.Nil(t, err)
+	assert.NotNil(t, value)
+	assert.Empty(t, value)
+	elem, ok := bitcask.rfiles.files[1]
+	assert.True(t, ok)
+	assert.NotNil(t, elem.Value.(*dataFile).mapping())
+}
+
+func TestMmapConcurrentMerge(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithMaxFileSize(1024), WithMmap(true))
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	ctx := context.Background()
+	n := 1024
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		err = bitcask.Put(ctx, []byte(key), []byte(key))
+		assert.Nil(t, err)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				key := strconv.Itoa(i)
+				value, err := bitcask.Get(ctx, []byte(key))
+				assert.Nil(t, err)
+				assert.Equal(t, key, string(value))
+			}
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		err = bitcask.Merge(ctx)
+		assert.Nil(t, err)
+	}
+	wg.Wait()
+}
+
+func TestMmapConcurrentRead(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir)
+	assert.Nil(t, err)
+	err = bitcask.Put(context.Background(), []byte("key"), []byte("value"))
+	assert.Nil(t, err)
+	err = bitcask.Close()
+	assert.Nil(t, err)
+
+	// a read that took the file to be active while another maps it
+	file, err := openReadFile(dataFilepath(dir, 1))
+	assert.Nil(t, err)
+	defer file.Close()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := file.mmap()
+		assert.Nil(t, err)
+	}()
+	for i := 0; i < 64; i++ {
+		err = file.readAt(0, 8, func(buf []byte, mapped bool) error {
+			return nil
+		})
+		assert.Nil(t, err)
+	}
+	wg.Wait()
+	assert.NotNil(t, file.mapping())
+}
@@ -1,32 +1,265 @@
 package bitcask
 
+import (
+	"log"
+	"os"
+	"time"
+)
+
 const (
-	defaultMaxFileSize = 1e9
-	defaultSyncOnPut   = false
+	defaultMaxFileSize          = 1e9
+	defaultCorruptionPolicy     = CorruptionFail
+	defaultOrderedKeydir        = false
+	defaultReadOnly             = false
+	defaultErrNotFound          = false
+	defaultCompressionThreshold = 64
 )
 
 var (
 	defaultOptions = Options{
-		maxFileSize: defaultMaxFileSize,
-		syncOnPut:   defaultSyncOnPut,
+		maxFileSize:          defaultMaxFileSize,
+		syncPolicy:           SyncNever,
+		corruptionPolicy:     defaultCorruptionPolicy,
+		orderedKeydir:        defaultOrderedKeydir,
+		readOnly:             defaultReadOnly,
+		errNotFound:          defaultErrNotFound,
+		compressionThreshold: defaultCompressionThreshold,
+		logger:               log.New(os.Stderr, "", log.LstdFlags),
 	}
 )
 
+// CorruptionPolicy decides what loading a data file does when it hits an
+// entry that is truncated or fails its CRC check.
+type CorruptionPolicy int
+
+const (
+	// CorruptionFail makes Open return a *CorruptedError.
+	CorruptionFail CorruptionPolicy = iota
+	// CorruptionSkip logs and skips the entry. A truncated entry ends the
+	// file.
+	CorruptionSkip
+	// CorruptionTruncate logs and truncates the data file at the entry.
+	CorruptionTruncate
+)
+
+// SyncPolicy decides when writes are flushed to disk. Whatever the policy,
+// a data file is synced when it is rotated, and on Sync and Close.
+type SyncPolicy struct {
+	mode     syncMode
+	writes   int
+	interval time.Duration
+}
+
+type syncMode int
+
+const (
+	syncNever syncMode = iota
+	syncAlways
+	syncEvery
+	syncInterval
+)
+
+var (
+	// SyncNever leaves flushing writes to the operating system.
+	SyncNever = SyncPolicy{mode: syncNever}
+	// SyncAlways makes every write return only once it is on disk.
+	// Concurrent writers share a single write and sync.
+	SyncAlways = SyncPolicy{mode: syncAlways}
+)
+
+// SyncEvery syncs once every n writes, in the write that reaches the
+// count. An n of one or less is SyncAlways.
+func SyncEvery(n int) SyncPolicy {
+	if n <= 1 {
+		return SyncAlways
+	}
+	return SyncPolicy{mode: syncEvery, writes: n}
+}
+
+// SyncInterval syncs from a background goroutine every interval. An
+// interval of zero or less is SyncAlways.
+func SyncInterval(interval time.Duration) SyncPolicy {
+	if interval <= 0 {
+		return SyncAlways
+	}
+	return SyncPolicy{mode: syncInterval, interval: interval}
+}
+
+// Logger is the interface used to report recovered errors.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
 type Option func(*Options)
 
 type Options struct {
-	maxFileSize uint32
-	syncOnPut   bool
+	maxFileSize          uint64
+	maxKeySize           uint32
+	maxValueSize         uint32
+	syncPolicy           SyncPolicy
+	corruptionPolicy     CorruptionPolicy
+	orderedKeydir        bool
+	readOnly             bool
+	errNotFound          bool
+	codec                Codec
+	compressionThreshold int
+	crypter              *crypter
+	mmap                 bool
+	maxOpenFiles         int
+	cacheSize            int
+	cacheValueSize       int
+	logger               Logger
 }
 
-func WithMaxFileSize(maxFileSize uint32) Option {
+func WithMaxFileSize(maxFileSize uint64) Option {
 	return func(opts *Options) {
 		opts.maxFileSize = maxFileSize
 	}
 }
 
+// WithMaxKeySize makes writes of keys longer than maxKeySize fail with
+// ErrKeyTooLarge. Entries with longer keys found when loading or merging
+// are taken to be corrupted, which keeps a damaged size field from making
+// them allocate that much. Zero means no limit but the entry format's.
+func WithMaxKeySize(maxKeySize uint32) Option {
+	return func(opts *Options) {
+		opts.maxKeySize = maxKeySize
+	}
+}
+
+// WithMaxValueSize makes writes of values longer than maxValueSize fail
+// with ErrValueTooLarge, like WithMaxKeySize.
+func WithMaxValueSize(maxValueSize uint32) Option {
+	return func(opts *Options) {
+		opts.maxValueSize = maxValueSize
+	}
+}
+
+// WithSyncOnPut sets the sync policy to SyncAlways if syncOnPut is set and
+// to SyncNever otherwise.
 func WithSyncOnPut(syncOnPut bool) Option {
 	return func(opts *Options) {
-		opts.syncOnPut = syncOnPut
+		if syncOnPut {
+			opts.syncPolicy = SyncAlways
+		} else {
+			opts.syncPolicy = SyncNever
+		}
+	}
+}
+
+func WithSyncPolicy(policy SyncPolicy) Option {
+	return func(opts *Options) {
+		opts.syncPolicy = policy
+	}
+}
+
+func WithCorruptionPolicy(policy CorruptionPolicy) Option {
+	return func(opts *Options) {
+		opts.corruptionPolicy = policy
+	}
+}
+
+// WithOrderedKeydir keeps keys sorted in memory, which makes Scan and
+// PrefixScan available at some cost to Get and Put.
+func WithOrderedKeydir(orderedKeydir bool) Option {
+	return func(opts *Options) {
+		opts.orderedKeydir = orderedKeydir
+	}
+}
+
+// WithReadOnly opens the store for reading only. Nothing in the directory
+// is created or written, so it may be on a read-only filesystem, and other
+// read-only opens are let in while a writer is kept out. Writes and merges
+// fail with ErrReadOnly.
+func WithReadOnly(readOnly bool) Option {
+	return func(opts *Options) {
+		opts.readOnly = readOnly
+	}
+}
+
+// WithErrNotFound makes Get and the other lookups return ErrNotFound for a
+// missing or expired key instead of a nil value, which tells a missing key
+// from an empty value.
+func WithErrNotFound(errNotFound bool) Option {
+	return func(opts *Options) {
+		opts.errNotFound = errNotFound
+	}
+}
+
+// WithCompression compresses values written from now on with codec. Values
+// already stored keep their codec, or none, and stay readable as long as
+// their codec is a built-in one or the one given here. A codec other than
+// the built-in ones must have an ID above 15, or Open returns ErrCodec. A
+// nil codec turns compression off.
+func WithCompression(codec Codec) Option {
+	return func(opts *Options) {
+		opts.codec = codec
+	}
+}
+
+// WithCompressionThreshold leaves values of up to threshold bytes
+// uncompressed, since compressing small values rarely pays off. It defaults
+// to 64 bytes.
+func WithCompressionThreshold(threshold int) Option {
+	return func(opts *Options) {
+		opts.compressionThreshold = threshold
+	}
+}
+
+// WithEncryption encrypts the key and value of every entry written from now
+// on, in data files and hint files alike, with AES-GCM under the current
+// key of provider. Entries already stored stay readable whatever key they
+// were encrypted with, or none, as long as provider has their key. A store
+// holding encrypted entries cannot be opened without it.
+func WithEncryption(provider KeyProvider) Option {
+	return func(opts *Options) {
+		opts.crypter = nil
+		if provider != nil {
+			opts.crypter = newCrypter(provider)
+		}
+	}
+}
+
+// WithMmap serves reads of data files that are no longer appended to from
+// a read-only memory mapping, which saves a system call and a buffer per
+// read. The active file is read as usual. Where mapping is not supported,
+// or fails, files are read as usual too.
+func WithMmap(mmap bool) Option {
+	return func(opts *Options) {
+		opts.mmap = mmap
+	}
+}
+
+// WithMaxOpenFiles keeps at most maxOpenFiles data files open for reading,
+// closing the least recently read ones beyond that. Files are reopened
+// when they are read again. Zero means no limit.
+func WithMaxOpenFiles(maxOpenFiles int) Option {
+	return func(opts *Options) {
+		opts.maxOpenFiles = maxOpenFiles
+	}
+}
+
+// WithValueCache keeps recently read values in memory, up to cacheSize
+// bytes of keys and values, and serves reads of them from there. Writes to
+// a key drop its value. Zero means no cache. CacheStats reports how well
+// it does.
+func WithValueCache(cacheSize int) Option {
+	return func(opts *Options) {
+		opts.cacheSize = cacheSize
+	}
+}
+
+// WithValueCacheThreshold keeps values longer than maxValueSize bytes out
+// of the value cache, so a few large values cannot crowd out many small
+// ones. Zero means no threshold.
+func WithValueCacheThreshold(maxValueSize int) Option {
+	return func(opts *Options) {
+		opts.cacheValueSize = maxValueSize
+	}
+}
+
+func WithLogger(logger Logger) Option {
+	return func(opts *Options) {
+		opts.logger = logger
 	}
 }
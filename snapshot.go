@@ -0,0 +1,132 @@
+package bitcask
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Snapshot is a read-only view of a store as of the moment it was taken.
+// The data files it reads are kept even if a merge replaces them, until
+// the snapshot is closed.
+type Snapshot struct {
+	bitcask *Bitcask
+	keys    []string
+	items   map[string]*item
+	fileIDs []uint32
+
+	once sync.Once
+}
+
+// Snapshot takes a snapshot of the store. Keys that have expired by then
+// are left out. The snapshot must be closed once it is no longer needed.
+func (bitcask *Bitcask) Snapshot() (*Snapshot, error) {
+	if err := bitcask.acquire(); err != nil {
+		return nil, err
+	}
+	defer bitcask.release()
+
+	// Holding mu keeps the batches and transactions being written out of
+	// the snapshot until they are applied in full, and holding pinMu keeps
+	// a merge from removing the files of the items until they are pinned.
+	bitcask.mu.Lock()
+	defer bitcask.mu.Unlock()
+	bitcask.pinMu.Lock()
+	defer bitcask.pinMu.Unlock()
+
+	keys, items := bitcask.keydir.Items()
+	snapshot := &Snapshot{
+		bitcask: bitcask,
+		keys:    make([]string, 0, len(keys)),
+		items:   make(map[string]*item, len(keys)),
+	}
+	pinned := make(map[uint32]bool)
+	now := uint32(time.Now().Unix())
+	for i, key := range keys {
+		item := items[i]
+		if item.expired(now) {
+			continue
+		}
+		snapshot.keys = append(snapshot.keys, key)
+		snapshot.items[key] = item
+		if !pinned[item.fileID] {
+			pinned[item.fileID] = true
+			snapshot.fileIDs = append(snapshot.fileIDs, item.fileID)
+			bitcask.pins[item.fileID] += 1
+		}
+	}
+	return snapshot, nil
+}
+
+// Get returns the value key had when the snapshot was taken. A missing key
+// is reported like Bitcask.Get does.
+func (snapshot *Snapshot) Get(ctx context.Context, key []byte) ([]byte, error) {
+	value, item, err := snapshot.get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, snapshot.bitcask.notFound()
+	}
+	return value, nil
+}
+
+// get returns the value of key and the item it was read from, or nil for
+// both if the key is missing.
+func (snapshot *Snapshot) get(ctx context.Context, key []byte) ([]byte, *item, error) {
+	item, ok := snapshot.items[string(key)]
+	if !ok {
+		return nil, nil, nil
+	}
+	if err := snapshot.bitcask.acquire(); err != nil {
+		return nil, nil, err
+	}
+	defer snapshot.bitcask.release()
+	value, err := snapshot.bitcask.readValue(key, item)
+	if err != nil {
+		return nil, nil, err
+	}
+	return value, item, nil
+}
+
+func (snapshot *Snapshot) Len() int {
+	return len(snapshot.keys)
+}
+
+// NewIterator returns an iterator over the keys and values of the
+// snapshot, in ascending key order if the store was opened
+// WithOrderedKeydir and in no particular order otherwise.
+func (snapshot *Snapshot) NewIterator(ctx context.Context) *Iterator {
+	return &Iterator{
+		ctx:  ctx,
+		get:  snapshot.get,
+		keys: snapshot.keys,
+	}
+}
+
+// Close releases the data files of the snapshot, removing those a merge
+// has replaced in the meantime. Closing a snapshot again does nothing, and
+// neither does closing it after the store, in which case replaced files
+// are merged again on the next merge after the store is reopened.
+func (snapshot *Snapshot) Close() error {
+	var err error
+	snapshot.once.Do(func() {
+		bitcask := snapshot.bitcask
+		if bitcask.acquire() != nil {
+			return
+		}
+		defer bitcask.release()
+
+		bitcask.pinMu.Lock()
+		defer bitcask.pinMu.Unlock()
+
+		for _, fileID := range snapshot.fileIDs {
+			bitcask.pins[fileID] -= 1
+			if bitcask.pins[fileID] == 0 {
+				delete(bitcask.pins, fileID)
+			}
+		}
+		err = bitcask.removeObsoleteLocked()
+	})
+	return err
+}
@@ -0,0 +1,132 @@
+package bitcask
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithMaxFileSize(256))
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	ctx := context.Background()
+	n := 64
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		err = bitcask.Put(ctx, []byte(key), []byte(key))
+		assert.Nil(t, err)
+	}
+
+	snapshot, err := bitcask.Snapshot()
+	assert.Nil(t, err)
+	assert.Equal(t, snapshot.Len(), n)
+
+	// writes and a merge after the snapshot was taken
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		if i%2 == 0 {
+			err = bitcask.Delete(ctx, []byte(key))
+		} else {
+			err = bitcask.Put(ctx, []byte(key), []byte("new"))
+		}
+		assert.Nil(t, err)
+	}
+	err = bitcask.Put(ctx, []byte("added"), []byte("value"))
+	assert.Nil(t, err)
+	fileIDs, err := dataFileIDs(dir)
+	assert.Nil(t, err)
+	err = bitcask.Merge(ctx)
+	assert.Nil(t, err)
+
+	value, err := snapshot.Get(ctx, []byte("added"))
+	assert.Nil(t, err)
+	assert.Nil(t, value)
+
+	it := snapshot.NewIterator(ctx)
+	m := 0
+	for it.Next() {
+		assert.Equal(t, it.Key(), it.Value())
+		m++
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, m, n)
+
+	// the merged files are removed once the snapshot is closed
+	_, err = os.Stat(dataFilepath(dir, fileIDs[0]))
+	assert.Nil(t, err)
+	err = snapshot.Close()
+	assert.Nil(t, err)
+	err = snapshot.Close()
+	assert.Nil(t, err)
+	for _, fileID := range fileIDs {
+		_, err = os.Stat(dataFilepath(dir, fileID))
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		value, err := bitcask.Get(ctx, []byte(key))
+		assert.Nil(t, err)
+		if i%2 == 0 {
+			assert.Nil(t, value)
+		} else {
+			assert.Equal(t, value, []byte("new"))
+		}
+	}
+}
+
+func TestSnapshotBatch(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir)
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	ctx := context.Background()
+	n := 16
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for round := 0; ; round++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			var batch Batch
+			for i := 0; i < n; i++ {
+				batch.Put([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(round)))
+			}
+			err := bitcask.Write(ctx, &batch)
+			assert.Nil(t, err)
+		}
+	}()
+
+	// every snapshot sees a batch in full or not at all
+	for i := 0; i < 256; i++ {
+		snapshot, err := bitcask.Snapshot()
+		assert.Nil(t, err)
+		var first []byte
+		for _, key := range snapshot.keys {
+			value, err := snapshot.Get(ctx, []byte(key))
+			assert.Nil(t, err)
+			if first == nil {
+				first = value
+			}
+			assert.Equal(t, first, value)
+		}
+		snapshot.Close()
+	}
+	close(done)
+	wg.Wait()
+}
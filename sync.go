@@ -0,0 +1,98 @@
+package bitcask
+
+import (
+	"time"
+)
+
+// commit runs fn, which appends to the active file, under mu. If the sync
+// policy calls for it, commit then waits until everything fn appended is on
+// disk. Under SyncAlways, writers that commit at the same time share a
+// single write and sync.
+func (bitcask *Bitcask) commit(fn func() error) error {
+	if err := bitcask.acquire(); err != nil {
+		return err
+	}
+	defer bitcask.release()
+
+	bitcask.mu.Lock()
+	err := fn()
+	fileID, offset := bitcask.fileID, bitcask.offset
+	sync := false
+	if err == nil {
+		switch policy := bitcask.options.syncPolicy; policy.mode {
+		case syncAlways:
+			sync = true
+		case syncEvery:
+			bitcask.unsynced += 1
+			if bitcask.unsynced >= policy.writes {
+				bitcask.unsynced = 0
+				sync = true
+			}
+		}
+	}
+	bitcask.mu.Unlock()
+
+	if !sync {
+		return err
+	}
+	return bitcask.syncTo(fileID, offset)
+}
+
+// syncPeriodically syncs the active file every interval until done is
+// closed.
+func (bitcask *Bitcask) syncPeriodically(interval time.Duration) {
+	bitcask.wg.Add(1)
+	go func() {
+		defer bitcask.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := bitcask.Sync(); err != nil && err != ErrClosed {
+					bitcask.options.logger.Printf("bitcask: sync failed: %v", err)
+				}
+			case <-bitcask.done:
+				return
+			}
+		}
+	}()
+}
+
+// syncTo makes sure the data file fileID is on disk up to offset. Syncs run
+// one at a time, and each writes and covers everything appended before it
+// started, so writers waiting behind one usually find their data already
+// synced.
+func (bitcask *Bitcask) syncTo(fileID uint32, offset uint64) error {
+	bitcask.syncMu.Lock()
+	defer bitcask.syncMu.Unlock()
+
+	if bitcask.syncedFileID > fileID || (bitcask.syncedFileID == fileID && bitcask.syncedOffset >= offset) {
+		return nil
+	}
+
+	bitcask.mu.Lock()
+	err := bitcask.flushLocked()
+	file, activeID, activeOffset := bitcask.file, bitcask.fileID, bitcask.offset
+	bitcask.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// Rotation syncs a data file before it is closed.
+	if activeID != fileID {
+		return nil
+	}
+	if err := file.Sync(); err != nil {
+		bitcask.mu.Lock()
+		rotated := bitcask.fileID != fileID
+		bitcask.mu.Unlock()
+		if rotated {
+			return nil
+		}
+		return err
+	}
+	bitcask.syncedFileID = activeID
+	bitcask.syncedOffset = activeOffset
+	return nil
+}
@@ -0,0 +1,72 @@
+package bitcask
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// isSynced locks syncMu before mu, in the order syncTo does.
+func isSynced(bitcask *Bitcask) bool {
+	bitcask.syncMu.Lock()
+	defer bitcask.syncMu.Unlock()
+	bitcask.mu.Lock()
+	defer bitcask.mu.Unlock()
+
+	return bitcask.syncedFileID == bitcask.fileID && bitcask.syncedOffset == bitcask.offset
+}
+
+func TestSyncEvery(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithSyncPolicy(SyncEvery(4)))
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	ctx := context.Background()
+	for i := 1; i <= 8; i++ {
+		key := strconv.Itoa(i)
+		err = bitcask.Put(ctx, []byte(key), []byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, isSynced(bitcask), i%4 == 0)
+	}
+}
+
+func TestSyncInterval(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithSyncPolicy(SyncInterval(10*time.Millisecond)))
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	ctx := context.Background()
+	err = bitcask.Put(ctx, []byte("key"), []byte("value"))
+	assert.Nil(t, err)
+
+	deadline := time.Now().Add(time.Second)
+	for !isSynced(bitcask) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, isSynced(bitcask))
+}
+
+func TestSyncNever(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir, WithSyncPolicy(SyncNever))
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	ctx := context.Background()
+	err = bitcask.Put(ctx, []byte("key"), []byte("value"))
+	assert.Nil(t, err)
+	assert.False(t, isSynced(bitcask))
+
+	err = bitcask.Sync()
+	assert.Nil(t, err)
+	assert.True(t, isSynced(bitcask))
+}
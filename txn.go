@@ -0,0 +1,137 @@
+package bitcask
+
+import (
+	"context"
+	"time"
+)
+
+// Txn is a transaction started by Update or View. Reads see the writes
+// made earlier in the same transaction. A Txn must not be used after the
+// function it was passed to returns, nor from several goroutines at once.
+type Txn struct {
+	ctx      context.Context
+	bitcask  *Bitcask
+	writable bool
+
+	// reads holds the version of every key read from the store, zero for
+	// a missing key, to be validated when the transaction ends.
+	reads  map[string]uint64
+	writes map[string]batchOp
+	batch  Batch
+}
+
+// Update runs fn in a read-write transaction and commits its writes
+// atomically if fn returns nil. The commit fails with a *ConflictError,
+// and nothing is written, if a key read by fn has been written since, in
+// which case the caller may run Update again.
+func (bitcask *Bitcask) Update(ctx context.Context, fn func(tx *Txn) error) error {
+	tx := &Txn{
+		ctx:      ctx,
+		bitcask:  bitcask,
+		writable: true,
+		reads:    make(map[string]uint64),
+		writes:   make(map[string]batchOp),
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// View runs fn in a read-only transaction whose reads are consistent: they
+// see the store as it was at a single moment. Rather than copying the
+// keydir like Snapshot does, View checks once fn returns nil that no key
+// read has been written since, and otherwise runs fn again, so fn may run
+// several times and should not have side effects besides its reads. View
+// returns the error of ctx if it is done before a run is consistent.
+func (bitcask *Bitcask) View(ctx context.Context, fn func(tx *Txn) error) error {
+	for {
+		tx := &Txn{
+			ctx:     ctx,
+			bitcask: bitcask,
+			reads:   make(map[string]uint64),
+		}
+		if err := fn(tx); err != nil {
+			return err
+		}
+		bitcask.mu.Lock()
+		err := tx.validateLocked(uint32(time.Now().Unix()))
+		bitcask.mu.Unlock()
+		if err == nil {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// Get returns the value of key. A missing or expired key is reported like
+// Bitcask.Get does.
+func (tx *Txn) Get(key []byte) ([]byte, error) {
+	if op, ok := tx.writes[string(key)]; ok {
+		if op.delete {
+			return nil, tx.bitcask.notFound()
+		}
+		return op.value, nil
+	}
+	value, version, err := tx.bitcask.GetWithVersion(tx.ctx, key)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	if _, ok := tx.reads[string(key)]; !ok {
+		tx.reads[string(key)] = version
+	}
+	return value, err
+}
+
+// Put sets the value of key when the transaction commits.
+func (tx *Txn) Put(key, value []byte) error {
+	if !tx.writable {
+		return ErrReadOnlyTxn
+	}
+	tx.batch.Put(key, value)
+	tx.writes[string(key)] = tx.batch.ops[len(tx.batch.ops)-1]
+	return nil
+}
+
+// Delete deletes key when the transaction commits.
+func (tx *Txn) Delete(key []byte) error {
+	if !tx.writable {
+		return ErrReadOnlyTxn
+	}
+	tx.batch.Delete(key)
+	tx.writes[string(key)] = tx.batch.ops[len(tx.batch.ops)-1]
+	return nil
+}
+
+// commit checks under the write lock that no key read has changed and
+// appends the writes as a batch. A transaction that wrote nothing is still
+// checked, as fn may have decided not to write based on what it read.
+func (tx *Txn) commit() error {
+	ts := uint32(time.Now().Unix())
+
+	bitcask := tx.bitcask
+	if tx.batch.Len() == 0 {
+		bitcask.mu.Lock()
+		defer bitcask.mu.Unlock()
+		return tx.validateLocked(ts)
+	}
+	return bitcask.commit(func() error {
+		if err := tx.validateLocked(ts); err != nil {
+			return err
+		}
+		return bitcask.writeLocked(tx.ctx, &tx.batch, ts)
+	})
+}
+
+// validateLocked returns a *ConflictError if a key read has been written
+// since.
+func (tx *Txn) validateLocked(now uint32) error {
+	for key, version := range tx.reads {
+		if actual := tx.bitcask.versionLocked([]byte(key), now); actual != version {
+			return &ConflictError{Key: []byte(key), Expected: version, Actual: actual}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package bitcask
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdate(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir)
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	ctx := context.Background()
+	err = bitcask.Put(ctx, []byte("deleted"), []byte("value"))
+	assert.Nil(t, err)
+
+	err = bitcask.Update(ctx, func(tx *Txn) error {
+		err := tx.Put([]byte("key"), []byte("value"))
+		assert.Nil(t, err)
+		value, err := tx.Get([]byte("key"))
+		assert.Nil(t, err)
+		assert.Equal(t, value, []byte("value"))
+
+		err = tx.Delete([]byte("deleted"))
+		assert.Nil(t, err)
+		value, err = tx.Get([]byte("deleted"))
+		assert.Nil(t, err)
+		assert.Nil(t, value)
+
+		// not visible outside the transaction before it commits
+		value, err = bitcask.Get(ctx, []byte("key"))
+		assert.Nil(t, err)
+		assert.Nil(t, value)
+		return nil
+	})
+	assert.Nil(t, err)
+
+	value, err := bitcask.Get(ctx, []byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, value, []byte("value"))
+	value, err = bitcask.Get(ctx, []byte("deleted"))
+	assert.Nil(t, err)
+	assert.Nil(t, value)
+
+	// an error discards the writes
+	errAbort := errors.New("abort")
+	err = bitcask.Update(ctx, func(tx *Txn) error {
+		tx.Put([]byte("key"), []byte("aborted"))
+		return errAbort
+	})
+	assert.Equal(t, err, errAbort)
+	value, err = bitcask.Get(ctx, []byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, value, []byte("value"))
+}
+
+func TestUpdateConflict(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir)
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	ctx := context.Background()
+	err = bitcask.Update(ctx, func(tx *Txn) error {
+		value, err := tx.Get([]byte("key"))
+		assert.Nil(t, err)
+		assert.Nil(t, value)
+
+		err = bitcask.Put(ctx, []byte("key"), []byte("concurrent"))
+		assert.Nil(t, err)
+
+		return tx.Put([]byte("other"), []byte("value"))
+	})
+	assert.True(t, errors.Is(err, ErrConflict))
+
+	value, err := bitcask.Get(ctx, []byte("other"))
+	assert.Nil(t, err)
+	assert.Nil(t, value)
+
+	// a transaction that only reads
+	err = bitcask.Update(ctx, func(tx *Txn) error {
+		_, err := tx.Get([]byte("key"))
+		assert.Nil(t, err)
+		return bitcask.Put(ctx, []byte("key"), []byte("again"))
+	})
+	assert.True(t, errors.Is(err, ErrConflict))
+}
+
+func TestUpdateTransfer(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir)
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	ctx := context.Background()
+	accounts := []string{"a", "b", "c", "d"}
+	total := 1000
+	for _, account := range accounts {
+		err = bitcask.Put(ctx, []byte(account), []byte(strconv.Itoa(total)))
+		assert.Nil(t, err)
+	}
+
+	balance := func(tx *Txn, account string) int {
+		value, err := tx.Get([]byte(account))
+		assert.Nil(t, err)
+		n, err := strconv.Atoi(string(value))
+		assert.Nil(t, err)
+		return n
+	}
+
+	n := 8
+	m := 64
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < m; {
+				from := accounts[(i+j)%len(accounts)]
+				to := accounts[(i+j+1)%len(accounts)]
+				err := bitcask.Update(ctx, func(tx *Txn) error {
+					a := balance(tx, from)
+					b := balance(tx, to)
+					tx.Put([]byte(from), []byte(strconv.Itoa(a-1)))
+					tx.Put([]byte(to), []byte(strconv.Itoa(b+1)))
+					return nil
+				})
+				if errors.Is(err, ErrConflict) {
+					continue
+				}
+				assert.Nil(t, err)
+				j++
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	err = bitcask.View(ctx, func(tx *Txn) error {
+		sum := 0
+		for _, account := range accounts {
+			sum += balance(tx, account)
+		}
+		assert.Equal(t, sum, total*len(accounts))
+		assert.Equal(t, tx.Put([]byte("a"), nil), ErrReadOnlyTxn)
+		return nil
+	})
+	assert.Nil(t, err)
+}
+
+func TestViewConsistent(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	bitcask, err := Open(dir)
+	assert.Nil(t, err)
+	defer bitcask.Close()
+
+	ctx := context.Background()
+	accounts := []string{"a", "b", "c", "d"}
+	total := 1000
+	for _, account := range accounts {
+		err = bitcask.Put(ctx, []byte(account), []byte(strconv.Itoa(total)))
+		assert.Nil(t, err)
+	}
+
+	balance := func(tx *Txn, account string) int {
+		value, err := tx.Get([]byte(account))
+		assert.Nil(t, err)
+		n, err := strconv.Atoi(string(value))
+		assert.Nil(t, err)
+		return n
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				from := accounts[(i+j)%len(accounts)]
+				to := accounts[(i+j+1)%len(accounts)]
+				err := bitcask.Update(ctx, func(tx *Txn) error {
+					a := balance(tx, from)
+					b := balance(tx, to)
+					tx.Put([]byte(from), []byte(strconv.Itoa(a-1)))
+					tx.Put([]byte(to), []byte(strconv.Itoa(b+1)))
+					return nil
+				})
+				if !errors.Is(err, ErrConflict) {
+					assert.Nil(t, err)
+				}
+			}
+		}(i)
+	}
+
+	// every view sees all of a transfer or none of it
+	for i := 0; i < 4096; i++ {
+		sum := 0
+		err = bitcask.View(ctx, func(tx *Txn) error {
+			sum = 0
+			for _, account := range accounts {
+				sum += balance(tx, account)
+			}
+			return nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, sum, total*len(accounts))
+	}
+	close(done)
+	wg.Wait()
+}